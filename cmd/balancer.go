@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"discovery/pkg/balancer"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/pflag"
+	"google.golang.org/grpc"
+)
+
+// add the flags of the registry options
+func addRegistryFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&namespace, "namespace", "/services", "key prefix of the services in registry, e.g. /prod/services")
+	flags.DurationVar(&dialTimeout, "dial-timeout", time.Second*balancer.EtcdDialTimeout, "timeout for dialling the registry")
+	flags.DurationVar(&requestTimeout, "request-timeout", time.Second*balancer.EtcdRequestTimeout, "timeout for requesting the registry")
+	flags.StringVar(&region, "region", "", "region of the server or client")
+	flags.StringVar(&zone, "zone", "", "zone of the server or client")
+}
+
+// add the flags for dialling the services
+func addDialFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&service, "service", "my-service", "service to dial, with the version and metadata selectors, e.g. my-service?version=v1.0.0&role=service, or a subtree of the services, e.g. team/payments/*")
+	flags.StringVar(&policy, "policy", balancer.WeightedRoundRobin, "default load balancing policy, e.g. weighted_round_robin, locality_round_robin, least_request, ring_hash, peak_ewma, round_robin or pick_first")
+	flags.DurationVar(&breakerLatency, "breaker-latency", 0, "request slower than it is a failure for the circuit breaker, disabled if zero")
+	flags.IntVar(&threshold, "locality-threshold", balancer.LocalityThreshold, "min percent of the healthy capacity in the same zone or region before spilling over to farther endpoints")
+}
+
+// the default service config with the load balancing policy, which is overridden by the
+// service config from the resolver
+func defaultServiceConfig() grpc.DialOption {
+	return grpc.WithDefaultServiceConfig(fmt.Sprintf(`{"loadBalancingPolicy": %q}`, policy))
+}
+
+// new a circuit breaker for the services and endpoints
+func newCircuitBreaker() *balancer.CircuitBreaker {
+	return balancer.NewCircuitBreaker(balancer.BreakerConfig{
+		Latency:     breakerLatency,
+		PerEndpoint: true,
+	})
+}
+
+// the registry options from the flags
+func registryOptions() []balancer.Option {
+	return []balancer.Option{
+		balancer.WithNamespace(namespace),
+		balancer.WithTTL(ttl),
+		balancer.WithInterval(interval),
+		balancer.WithDialTimeout(dialTimeout),
+		balancer.WithRequestTimeout(requestTimeout),
+		balancer.WithLocality(region, zone),
+		balancer.WithLocalityThreshold(threshold),
+	}
+}
+
+// new a balancer with the registry uris, or with the etcd address by default
+func newBalancer() *balancer.EtcdBalancer {
+	opts := registryOptions()
+	if len(registries) == 0 {
+		return balancer.NewEtcdBalancer(addr, opts...)
+	}
+
+	var list []balancer.Registry
+	for _, uri := range registries {
+		r, err := balancer.NewRegistry(uri, opts...)
+		if err != nil {
+			log.Fatalf("new registry {%s}: %v", uri, err)
+		}
+		list = append(list, r)
+	}
+	if len(list) == 1 {
+		return balancer.NewBalancerWithRegistry(list[0], opts...)
+	}
+	return balancer.NewBalancerWithRegistry(balancer.NewMultiRegistry(list...), opts...)
+}
@@ -3,7 +3,6 @@ package cmd
 import (
 	"context"
 	"discovery/apis/greeter"
-	"discovery/pkg/balancer"
 	"log"
 	"time"
 
@@ -23,6 +22,9 @@ var cliCmd = &cobra.Command{
 
 func init() {
 	cliCmd.PersistentFlags().StringVar(&addr, "addr", "localhost:2379", "etcd server's address")
+	cliCmd.PersistentFlags().StringArrayVar(&registries, "registry", nil, "registry uri, e.g. etcd://localhost:2379, file:///path or dns://localhost:53/?port=15001, repeat for combining, overrides the addr")
+	addRegistryFlags(cliCmd.PersistentFlags())
+	addDialFlags(cliCmd.PersistentFlags())
 }
 
 func init() {
@@ -31,11 +33,14 @@ func init() {
 
 // the main process for the client subcommand
 func cli() {
-	r := balancer.NewEtcdBalancer(addr).Resolver()
+	r := newBalancer().Resolver()
 	resolver.Register(r)
+	breaker := newCircuitBreaker()
 	conn, err := grpc.Dial(
-		r.Scheme()+"://authority/my-service",
-		grpc.WithBalancerName("round_robin"),
+		r.Scheme()+"://authority/"+service,
+		defaultServiceConfig(),
+		grpc.WithUnaryInterceptor(breaker.UnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(breaker.StreamClientInterceptor()),
 		grpc.WithInsecure(),
 	)
 	if err != nil {
@@ -3,7 +3,6 @@ package cmd
 import (
 	"bytes"
 	"context"
-	"discovery/pkg/balancer"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -29,6 +28,9 @@ var proxyCmd = &cobra.Command{
 
 func init() {
 	proxyCmd.PersistentFlags().StringVar(&addr, "addr", "localhost:2379", "etcd server's address")
+	proxyCmd.PersistentFlags().StringArrayVar(&registries, "registry", nil, "registry uri, e.g. etcd://localhost:2379, file:///path or dns://localhost:53/?port=15001, repeat for combining, overrides the addr")
+	addRegistryFlags(proxyCmd.PersistentFlags())
+	addDialFlags(proxyCmd.PersistentFlags())
 }
 
 func init() {
@@ -40,11 +42,14 @@ var conn *grpc.ClientConn
 
 // start the proxy server
 func proxy() {
-	r := balancer.NewEtcdBalancer(addr).Resolver()
+	r := newBalancer().Resolver()
 	resolver.Register(r)
+	breaker := newCircuitBreaker()
 	c, err := grpc.Dial(
-		r.Scheme()+"://author/my-service",
-		grpc.WithBalancerName("round_robin"),
+		r.Scheme()+"://author/"+service,
+		defaultServiceConfig(),
+		grpc.WithUnaryInterceptor(breaker.UnaryClientInterceptor()),
+		grpc.WithStreamInterceptor(breaker.StreamClientInterceptor()),
 		grpc.WithInsecure(),
 	)
 	conn = c
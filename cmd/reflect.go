@@ -3,7 +3,6 @@ package cmd
 import (
 	"bytes"
 	"context"
-	"discovery/pkg/balancer"
 	"log"
 	"strings"
 
@@ -26,6 +25,9 @@ var reflectCmd = &cobra.Command{
 
 func init() {
 	reflectCmd.PersistentFlags().StringVar(&addr, "addr", "localhost:2379", "etcd server's address")
+	reflectCmd.PersistentFlags().StringArrayVar(&registries, "registry", nil, "registry uri, e.g. etcd://localhost:2379, file:///path or dns://localhost:53/?port=15001, repeat for combining, overrides the addr")
+	addRegistryFlags(reflectCmd.PersistentFlags())
+	addDialFlags(reflectCmd.PersistentFlags())
 }
 
 func init() {
@@ -34,11 +36,11 @@ func init() {
 
 // the main process for the reflect subcommand
 func reflect() {
-	r := balancer.NewEtcdBalancer(addr).Resolver()
+	r := newBalancer().Resolver()
 	resolver.Register(r)
 	conn, err := grpc.Dial(
-		r.Scheme()+"://author/my-service",
-		grpc.WithBalancerName("round_robin"),
+		r.Scheme()+"://author/"+service,
+		defaultServiceConfig(),
 		grpc.WithInsecure(),
 	)
 	if err != nil {
@@ -1,19 +1,21 @@
 package cmd
 
 import (
+	"context"
 	"discovery/apis/greeter"
 	"discovery/pkg/balancer"
-	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/spf13/cobra"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/reflection"
 )
 
@@ -31,6 +33,10 @@ func init() {
 	serveCmd.PersistentFlags().StringVar(&ip, "ip", "localhost", "grpc server's ip")
 	serveCmd.PersistentFlags().StringVar(&port, "port", "15001", "grpc server's port")
 	serveCmd.PersistentFlags().StringVar(&addr, "addr", "localhost:2379", "etcd server's address")
+	serveCmd.PersistentFlags().DurationVar(&ttl, "ttl", time.Second*balancer.EtcdRegisterTTL, "register ttl for service")
+	serveCmd.PersistentFlags().DurationVar(&interval, "interval", time.Second*balancer.TimerCheckInterval, "interval time for checking if service is deleted")
+	serveCmd.PersistentFlags().IntVar(&weight, "weight", balancer.DefaultWeight, "weight of the endpoint for the weighted round robin balancer")
+	addRegistryFlags(serveCmd.PersistentFlags())
 }
 
 func init() {
@@ -49,6 +55,9 @@ func newService() *balancer.Service {
 				Protocol: "GRPC",
 				Version:  "v1.0.0",
 				Metadata: map[string]string{"role": "service"},
+				Weight:   weight,
+				Region:   region,
+				Zone:     zone,
 			},
 		},
 	}
@@ -56,7 +65,7 @@ func newService() *balancer.Service {
 
 // the main process for the server subcommand
 func serve() {
-	lis, err := net.Listen("tcp", fmt.Sprintf("%s:%s", ip, port))
+	lis, err := net.Listen("tcp", net.JoinHostPort(ip, port))
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
@@ -64,25 +73,48 @@ func serve() {
 
 	greeter.RegisterGreeterServer(s, &greeter.Server{})
 
-	// register the service to etcd registry
-	etcdBalancer := balancer.NewEtcdBalancer(addr)
+	// register the health service, it's not serving until the server is started
+	hs := health.NewServer()
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(s, hs)
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go etcdBalancer.Register(&wg, newService())
+	// new the etcd registry, which doesn't wait for the connection
+	opts := registryOptions()
+	registry, err := balancer.NewEtcdRegistry(addr, opts...)
+	if err != nil {
+		log.Fatalf("new etcd registry: %v", err)
+	}
+	registrar := balancer.NewRegistrar(registry, opts...)
+
+	// the health client of the server itself, which doesn't wait for the connection
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		log.Fatalf("dial health service: %v", err)
+	}
+
+	// register the service to etcd registry when it's serving, and deregister it when
+	// it's not serving, the registration is kept in the background until closed
+	registration, err := registrar.RegisterWithHealth(newService(), healthpb.NewHealthClient(conn), "")
+	if err != nil {
+		log.Fatalf("register: %v", err)
+	}
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT, syscall.SIGKILL, syscall.SIGHUP, syscall.SIGQUIT)
 	go func() {
 		select {
 		case <-sig:
-			// unregister the service first
-			if err := etcdBalancer.UnRegister(); err != nil {
+			// stop serving and unregister the service first
+			hs.Shutdown()
+			ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+			if err := registration.Close(ctx); err != nil {
 				log.Printf("unregister: %v", err)
 			}
+			cancel()
+			conn.Close()
 
-			// close the etcd balancer
-			etcdBalancer.Close()
+			// close the etcd registry
+			registry.Close()
 
 			// stop the grpc server
 			s.GracefulStop()
@@ -93,9 +125,8 @@ func serve() {
 
 	// Register reflection service on gRPC server.
 	reflection.Register(s)
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
 	if err := s.Serve(lis); err != nil {
 		log.Fatalf("failed to serve: %v", err)
 	}
-
-	wg.Wait()
 }
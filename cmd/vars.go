@@ -1,7 +1,24 @@
 package cmd
 
+import "time"
+
 var (
 	ip   string
 	port string
 	addr string
+
+	registries []string
+	service    string
+	policy     string
+	weight     int
+
+	namespace      string
+	ttl            time.Duration
+	interval       time.Duration
+	dialTimeout    time.Duration
+	requestTimeout time.Duration
+	region         string
+	zone           string
+	threshold      int
+	breakerLatency time.Duration
 )
@@ -10,6 +10,9 @@ require (
 	github.com/jhump/protoreflect v1.7.0
 	github.com/satori/go.uuid v1.2.0
 	github.com/spf13/cobra v1.0.0
+	github.com/spf13/pflag v1.0.3
+	golang.org/x/net v0.0.0-20200226121028-0de0cce0169b
 	google.golang.org/grpc v1.29.0
 	google.golang.org/protobuf v1.24.0
+	gopkg.in/yaml.v2 v2.2.2
 )
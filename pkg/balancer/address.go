@@ -0,0 +1,44 @@
+package balancer
+
+import (
+	"net"
+
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+)
+
+// the keys of the endpoint and the service id in address attributes
+type (
+	endpointKey  struct{}
+	serviceIDKey struct{}
+)
+
+// newAddress returns the resolver address of the endpoint, e.g. '[::1]:8000' for IPv6, the
+// endpoint and the id of the service owning it are carried by attributes
+func newAddress(id string, ep Endpoint) resolver.Address {
+	return resolver.Address{
+		Addr:       net.JoinHostPort(ep.IP, ep.Port),
+		Attributes: attributes.New(endpointKey{}, ep, serviceIDKey{}, id),
+	}
+}
+
+// AddressEndpoint returns the endpoint from the address attributes, which is resolved from
+// registry, so that the balancers, pickers and interceptors can use the registry metadata
+func AddressEndpoint(addr resolver.Address) (Endpoint, bool) {
+	if addr.Attributes != nil {
+		if ep, ok := addr.Attributes.Value(endpointKey{}).(Endpoint); ok {
+			return ep, true
+		}
+	}
+	return Endpoint{}, false
+}
+
+// AddressServiceID returns the id of the service owning the endpoint from the address attributes
+func AddressServiceID(addr resolver.Address) string {
+	if addr.Attributes != nil {
+		if id, ok := addr.Attributes.Value(serviceIDKey{}).(string); ok {
+			return id
+		}
+	}
+	return ""
+}
@@ -0,0 +1,19 @@
+package balancer
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff returns the exponential backoff duration for the retries, which starts from
+// the base and is limited to the max, with a random jitter up to 20 percent
+func backoff(retries int, base time.Duration, max time.Duration) time.Duration {
+	d := base
+	for i := 0; i < retries && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d - time.Duration(rand.Int63n(int64(d)/5+1))
+}
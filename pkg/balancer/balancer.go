@@ -2,14 +2,8 @@ package balancer
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
-	"log"
-	"strings"
 	"sync"
-	"time"
 
-	"github.com/coreos/etcd/clientv3"
 	"google.golang.org/grpc/resolver"
 )
 
@@ -22,38 +16,55 @@ const (
 	EtcdRegisterTTL = 30
 	// TimerCheckInterval - default interval time for checking if service is deleted
 	TimerCheckInterval = 15
+	// RegisterRetryInterval - default base interval time for retrying to register service
+	RegisterRetryInterval = 1
+	// EtcdWatchRetryInterval - max interval time for resuming the broken watch or listing again
+	EtcdWatchRetryInterval = 30
+	// ResolveNowInterval - min interval time for listing the service again when grpc asks to resolve
+	ResolveNowInterval = 10
 )
 
 var (
 	scheme = "services"
 )
 
-// EtcdBalancer defines a balancer based on etcd
+// EtcdBalancer defines a balancer based on registry, etcd by default
 type EtcdBalancer struct {
-	client      *clientv3.Client // the etcd client
-	resolver    resolver.Builder // the etcd resolver
-	servicePath string           // the service path
-	done        chan struct{}    // notify exit
+	registry  Registry         // the registry backend
+	opts      *options         // the options of the balancer
+	registrar *Registrar       // the registrar for the services
+	resolver  resolver.Builder // the registry resolver
+	done      chan struct{}    // notify exit
+
+	mu      sync.Mutex
+	pending map[*Service]context.CancelFunc // cancel the services which are registering
 }
 
 // NewEtcdBalancer returns a etcd balancer
-func NewEtcdBalancer(addr string) *EtcdBalancer {
-	// new a etcd client which based on grpc protocol
-	client, err := clientv3.New(clientv3.Config{
-		Endpoints:   strings.Split(addr, ";"),
-		DialTimeout: time.Second * EtcdDialTimeout,
-	})
+func NewEtcdBalancer(addr string, opts ...Option) *EtcdBalancer {
+	// new a etcd registry
+	registry, err := NewEtcdRegistry(addr, opts...)
 	if err != nil {
 		panic(err)
 	}
 
-	// new a etcd resolver
-	resolver := newResolver(client)
+	return NewBalancerWithRegistry(registry, opts...)
+}
+
+// NewBalancerWithRegistry returns a balancer based on the registry backend
+func NewBalancerWithRegistry(registry Registry, opts ...Option) *EtcdBalancer {
+	o := newOptions(opts...)
+
+	// new a registry resolver builder
+	resolver := newResolverBuilder(registry, o)
 
 	return &EtcdBalancer{
-		client:   client,
-		resolver: resolver,
-		done:     make(chan struct{}),
+		registry:  registry,
+		opts:      o,
+		registrar: NewRegistrar(registry, opts...),
+		resolver:  resolver,
+		done:      make(chan struct{}),
+		pending:   make(map[*Service]context.CancelFunc),
 	}
 }
 
@@ -69,6 +80,9 @@ type Endpoint struct {
 	Protocol string            `json:"protocol"`
 	Version  string            `json:"version"`
 	Metadata map[string]string `json:"metadata"`
+	Weight   int               `json:"weight,omitempty"`
+	Region   string            `json:"region,omitempty"`
+	Zone     string            `json:"zone,omitempty"`
 }
 
 // Service structure for registering
@@ -78,91 +92,84 @@ type Service struct {
 	Endpoints []Endpoint `json:"endpoints"`
 }
 
-func (s *EtcdBalancer) register(service *Service) error {
-	ctx := context.Background()
-	// try to get the specific service instance information from etcd registry
-	res, err := s.client.Get(ctx, s.servicePath)
-	if err != nil {
-		return err
-	}
-	if res.Count == 0 {
-		// if there is no service, try to register service to etcd registry
-		if err := s.keepalive(ctx, service); err != nil {
-			return err
-		}
-	}
-	return nil
+// Registrar returns the registrar based on the same registry
+func (s *EtcdBalancer) Registrar() *Registrar {
+	return s.registrar
 }
 
-// Register service with service path to registry
+// Register service with service path to registry, it blocks until the balancer is closed.
+// The service is kept alive and registered again when the lease is lost. It can be called
+// for many services, each of them is registered with its own key and lease.
+//
+// Deprecated: use Registrar().Register instead, which respects the context.
 func (s *EtcdBalancer) Register(wg *sync.WaitGroup, service *Service) error {
 	defer wg.Done()
 
-	// init the service path
-	s.servicePath = "/" + scheme + "/" + service.Name + "/" + service.ID
-
-	// register once before starting the timer
-	if err := s.register(service); err != nil {
-		panic(err)
-	}
-
-	// start a timer for register and keep alive the service
-	ticker := time.NewTimer(time.Second * TimerCheckInterval)
-	defer ticker.Stop()
-
-	for {
+	// retry to register the service until the balancer is closed or unregistered
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
 		select {
 		case <-s.done:
-			return nil
-		case <-ticker.C:
-			// register the service periodly
-			if err := s.register(service); err != nil {
-				log.Printf("register service {%v}: %v", service, err)
-			}
-			ticker.Reset(time.Second * TimerCheckInterval)
+			cancel()
+		case <-ctx.Done():
 		}
-	}
-}
+	}()
 
-func (s *EtcdBalancer) keepalive(ctx context.Context, service *Service) error {
-	// Grant creates a new lease.
-	lease, err := s.client.Grant(ctx, EtcdRegisterTTL)
-	if err != nil {
-		return err
-	}
+	s.mu.Lock()
+	s.pending[service] = cancel
+	s.mu.Unlock()
+
+	registration, err := s.registrar.Register(ctx, service)
+
+	s.mu.Lock()
+	delete(s.pending, service)
+	s.mu.Unlock()
 
-	body, err := json.Marshal(service)
-	if err != nil {
-		return err
-	}
-	// put the service into etcd registry
-	res, err := s.client.Put(ctx, s.servicePath, string(body), clientv3.WithLease(lease.ID))
 	if err != nil {
 		return err
 	}
-	log.Printf("Put service {%s}, revision: {%v}", s.servicePath, res.Header.Revision)
 
-	// KeepAlive keeps the given lease alive forever
-	if _, err := s.client.KeepAlive(ctx, lease.ID); err != nil {
-		return err
+	// the service is unregistered during registering
+	if ctx.Err() != nil {
+		registration.Close(context.Background())
+		return nil
 	}
 
+	<-s.done
 	return nil
 }
 
-// UnRegister service with service path from etcd registry
-func (s *EtcdBalancer) UnRegister() error {
-	if s.servicePath == "" {
-		return errors.New("service path is empty")
+// UnRegisterService deregisters the service from registry, the lease is revoked
+func (s *EtcdBalancer) UnRegisterService(service *Service) error {
+	s.mu.Lock()
+	cancelPending, ok := s.pending[service]
+	s.mu.Unlock()
+
+	// the service is still registering
+	if ok {
+		cancelPending()
+		return nil
 	}
 
-	res, err := s.client.Delete(context.Background(), s.servicePath)
-	if err != nil {
-		return err
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.requestTimeout)
+	defer cancel()
+
+	return s.registrar.Deregister(ctx, service)
+}
+
+// UnRegister all the services from registry, the leases are revoked
+func (s *EtcdBalancer) UnRegister() error {
+	s.mu.Lock()
+	for _, cancel := range s.pending {
+		cancel()
 	}
-	log.Printf("service {%s} is deleted -> %v", s.servicePath, (res.Deleted == 1))
+	s.mu.Unlock()
 
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.requestTimeout)
+	defer cancel()
+
+	return s.registrar.DeregisterAll(ctx)
 }
 
 // Close the etcd balancer gracefully
@@ -172,8 +179,8 @@ func (s *EtcdBalancer) Close() {
 		close(s.done)
 	}
 
-	// close the etcd client
-	if s.client != nil {
-		s.client.Close()
+	// close the registry
+	if s.registry != nil {
+		s.registry.Close()
 	}
 }
@@ -0,0 +1,354 @@
+package balancer
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// BreakerInterval - default interval time for counting the error rate
+	BreakerInterval = 10
+	// BreakerFailurePercentage - default error rate in percent for opening the circuit
+	BreakerFailurePercentage = 50
+	// BreakerMinRequests - default min number of the requests in the interval for the error rate
+	BreakerMinRequests = 20
+	// BreakerOpenTime - default time for failing fast before probing again, it's also the
+	// deadline of the probes, the circuit is opened again if they aren't finished in time
+	BreakerOpenTime = 30
+	// BreakerProbes - default number of the successful probes for closing the circuit
+	BreakerProbes = 3
+)
+
+// ErrCircuitOpen - the circuit of the service or endpoint is open, the request fails fast
+var ErrCircuitOpen = status.Error(codes.Unavailable, "circuit breaker is open")
+
+// BreakerConfig defines the thresholds of the circuit breaker, the zero values are the defaults
+type BreakerConfig struct {
+	Interval          time.Duration // the interval time for counting the error rate
+	FailurePercentage int           // the error rate in percent for opening the circuit
+	MinRequests       int           // the min number of the requests in the interval for the error rate
+	Latency           time.Duration // the unary request slower than it is a failure, disabled if zero
+	OpenTime          time.Duration // the time for failing fast before probing again, and the deadline of the probes
+	Probes            int           // the number of the successful probes for closing the circuit
+	PerEndpoint       bool          // trip the circuit of each endpoint besides the service
+}
+
+// withDefaults returns the config with the default values
+func (c BreakerConfig) withDefaults() BreakerConfig {
+	if c.Interval <= 0 {
+		c.Interval = time.Second * BreakerInterval
+	}
+	if c.FailurePercentage <= 0 {
+		c.FailurePercentage = BreakerFailurePercentage
+	}
+	if c.MinRequests <= 0 {
+		c.MinRequests = BreakerMinRequests
+	}
+	if c.OpenTime <= 0 {
+		c.OpenTime = time.Second * BreakerOpenTime
+	}
+	if c.Probes <= 0 {
+		c.Probes = BreakerProbes
+	}
+	return c
+}
+
+// the states of a circuit
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuit defines the state of the circuit for a service or endpoint
+type circuit struct {
+	mu        sync.Mutex
+	state     int       // closed, open or half open
+	failures  int       // the number of the failures in the interval
+	successes int       // the number of the successes in the interval, or the probes when half open
+	probing   int       // the number of the in-flight probes when half open
+	since     time.Time // the start time of the interval, or the time of opening or probing
+}
+
+// allow returns true if the request can be sent, a limited number of probes are allowed
+// when the circuit is half open, and the circuit is opened again if the probes are lost
+func (c *circuit) allow(config BreakerConfig) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case circuitOpen:
+		if time.Since(c.since) < config.OpenTime {
+			return false
+		}
+		c.state, c.successes, c.probing, c.since = circuitHalfOpen, 0, 0, time.Now()
+		fallthrough
+
+	case circuitHalfOpen:
+		if c.successes+c.probing >= config.Probes {
+			// the probes aren't finished before the deadline
+			if c.probing > 0 && time.Since(c.since) > config.OpenTime {
+				c.state, c.since = circuitOpen, time.Now()
+			}
+			return false
+		}
+		c.probing++
+	}
+	return true
+}
+
+// release the probe which is canceled without a result
+func (c *circuit) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == circuitHalfOpen && c.probing > 0 {
+		c.probing--
+	}
+}
+
+// record the result of the request, the circuit is opened if the error rate exceeds the
+// threshold, or any probe is failed
+func (c *circuit) record(config BreakerConfig, failed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case circuitHalfOpen:
+		// the probe may be lost before the circuit is opened again
+		if c.probing > 0 {
+			c.probing--
+		}
+		if failed {
+			c.state, c.since = circuitOpen, time.Now()
+			return
+		}
+		c.successes++
+		if c.successes >= config.Probes {
+			c.state, c.failures, c.successes, c.since = circuitClosed, 0, 0, time.Now()
+		}
+
+	case circuitClosed:
+		// start a new interval for the error rate
+		if time.Since(c.since) > config.Interval {
+			c.failures, c.successes, c.since = 0, 0, time.Now()
+		}
+		if !failed {
+			c.successes++
+			return
+		}
+		c.failures++
+
+		total := c.failures + c.successes
+		if total >= config.MinRequests && c.failures*100 >= config.FailurePercentage*total {
+			c.state, c.since = circuitOpen, time.Now()
+		}
+	}
+}
+
+// CircuitBreaker trips the circuit of the target service, and optionally of each endpoint, on
+// the error rate or latency. The requests fail fast with 'Unavailable' while the circuit is open,
+// then a few probes are allowed after a while, and the circuit is closed if they're successful.
+// The circuit of the endpoints are only checked by the balancers in this package.
+type CircuitBreaker struct {
+	config BreakerConfig // the default config for the services
+
+	mu       sync.Mutex
+	configs  map[string]BreakerConfig // the config of the services
+	circuits map[string]*circuit      // the circuits of the services and endpoints
+}
+
+// NewCircuitBreaker returns a circuit breaker with the default config for the services
+func NewCircuitBreaker(config BreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{
+		config:   config.withDefaults(),
+		configs:  make(map[string]BreakerConfig),
+		circuits: make(map[string]*circuit),
+	}
+}
+
+// Configure sets the config of the service, which is the service name in the dial target
+func (b *CircuitBreaker) Configure(service string, config BreakerConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.configs[service] = config.withDefaults()
+}
+
+// serviceConfig returns the config of the service
+func (b *CircuitBreaker) serviceConfig(service string) BreakerConfig {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if config, ok := b.configs[service]; ok {
+		return config
+	}
+	return b.config
+}
+
+// forget the circuit of the endpoint which isn't resolved any more
+func (b *CircuitBreaker) forget(service string, addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.circuits, service+"@"+addr)
+}
+
+// circuit returns the circuit by the key
+func (b *CircuitBreaker) circuit(key string) *circuit {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.circuits[key]
+	if !ok {
+		c = &circuit{since: time.Now()}
+		b.circuits[key] = c
+	}
+	return c
+}
+
+// targetService returns the service name from the dial target, e.g. 'my-service' for
+// 'services://authority/my-service?version=v1.0.0'
+func targetService(target string) string {
+	if i := strings.Index(target, "://"); i >= 0 {
+		target = target[i+3:]
+		if i := strings.Index(target, "/"); i >= 0 {
+			target = target[i+1:]
+		}
+	}
+	if i := strings.Index(target, "?"); i >= 0 {
+		target = target[:i]
+	}
+	return target
+}
+
+// the context key of the endpoint breaker
+type breakerKey struct{}
+
+// endpointBreaker checks and records the circuits of the endpoints for a service, it's passed
+// to the pickers by the context
+type endpointBreaker struct {
+	breaker *CircuitBreaker
+	service string
+	config  BreakerConfig
+}
+
+// allow returns true if the request can be sent to the endpoint
+func (e *endpointBreaker) allow(addr string) bool {
+	return e.breaker.circuit(e.service + "@" + addr).allow(e.config)
+}
+
+// record the result of the request to the endpoint
+func (e *endpointBreaker) record(addr string, err error, latency time.Duration) {
+	e.breaker.circuit(e.service+"@"+addr).record(e.config, e.failed(err, latency))
+}
+
+// failed returns true if the request is failed or too slow
+func (e *endpointBreaker) failed(err error, latency time.Duration) bool {
+	return isFailure(err) || (e.config.Latency > 0 && latency > e.config.Latency)
+}
+
+// endpointBreakerFromContext returns the endpoint breaker from the context
+func endpointBreakerFromContext(ctx context.Context) *endpointBreaker {
+	if ctx == nil {
+		return nil
+	}
+	e, _ := ctx.Value(breakerKey{}).(*endpointBreaker)
+	return e
+}
+
+// start the request to the target service, it returns the endpoint breaker and the context with
+// it, or the error if the circuit of the service is open
+func (b *CircuitBreaker) start(ctx context.Context, target string) (context.Context, *endpointBreaker, error) {
+	service := targetService(target)
+	e := &endpointBreaker{breaker: b, service: service, config: b.serviceConfig(service)}
+	if !b.circuit(service).allow(e.config) {
+		return ctx, nil, ErrCircuitOpen
+	}
+
+	if e.config.PerEndpoint {
+		ctx = context.WithValue(ctx, breakerKey{}, e)
+	}
+	return ctx, e, nil
+}
+
+// finish the request to the target service with the result
+func (e *endpointBreaker) finish(err error, latency time.Duration) {
+	e.breaker.circuit(e.service).record(e.config, e.failed(err, latency))
+}
+
+// cancel the request to the target service without a result
+func (e *endpointBreaker) cancel() {
+	e.breaker.circuit(e.service).release()
+}
+
+// UnaryClientInterceptor returns the unary client interceptor with the circuit breaker
+func (b *CircuitBreaker) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, e, err := b.start(ctx, cc.Target())
+		if err != nil {
+			return err
+		}
+
+		start := time.Now()
+		err = invoker(ctx, method, req, reply, cc, opts...)
+		e.finish(err, time.Since(start))
+
+		return err
+	}
+}
+
+// StreamClientInterceptor returns the stream client interceptor with the circuit breaker, the
+// result of the stream is recorded when it's finished, the latency isn't considered. The stream
+// canceled before it's finished has no result, but it doesn't hold the probe of the circuit.
+func (b *CircuitBreaker) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		ctx, e, err := b.start(ctx, cc.Target())
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			cancel()
+			e.finish(err, 0)
+			return nil, err
+		}
+
+		s := &breakerStream{ClientStream: stream, breaker: e, cancel: cancel}
+		go func() {
+			<-ctx.Done()
+			s.once.Do(e.cancel)
+		}()
+		return s, nil
+	}
+}
+
+// the client stream records the result when it's finished
+type breakerStream struct {
+	grpc.ClientStream
+	breaker *endpointBreaker
+	cancel  context.CancelFunc // stop watching the context after the stream is finished
+	once    sync.Once
+}
+
+// RecvMsg receives the message, and records the result when the stream is finished
+func (s *breakerStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == io.EOF {
+		s.once.Do(func() { s.breaker.finish(nil, 0) })
+		s.cancel()
+	} else if err != nil {
+		s.once.Do(func() { s.breaker.finish(err, 0) })
+		s.cancel()
+	}
+	return err
+}
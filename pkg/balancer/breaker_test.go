@@ -0,0 +1,107 @@
+package balancer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// open the circuit by the failures
+func openCircuit(c *circuit, config BreakerConfig) {
+	for i := 0; i < config.MinRequests; i++ {
+		c.record(config, true)
+	}
+}
+
+func TestCircuit(t *testing.T) {
+	config := BreakerConfig{MinRequests: 4, OpenTime: time.Millisecond * 20, Probes: 2}.withDefaults()
+
+	tests := []struct {
+		name  string
+		probe func(c *circuit) // finish or lose the probes after the circuit is half open
+		state int              // the expected state after the probes
+		allow bool             // the expected result of the next request
+		wait  time.Duration    // wait before the next request
+	}{
+		{
+			name: "successful probes close the circuit",
+			probe: func(c *circuit) {
+				c.record(config, false)
+				c.record(config, false)
+			},
+			state: circuitClosed,
+			allow: true,
+		},
+		{
+			name: "failed probe opens the circuit",
+			probe: func(c *circuit) {
+				c.record(config, true)
+			},
+			state: circuitOpen,
+			allow: false,
+		},
+		{
+			name: "canceled probes are released",
+			probe: func(c *circuit) {
+				c.release()
+				c.release()
+			},
+			state: circuitHalfOpen,
+			allow: true,
+		},
+		{
+			name:  "lost probes open the circuit after the deadline",
+			probe: func(c *circuit) {},
+			state: circuitOpen,
+			allow: false,
+			wait:  config.OpenTime * 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &circuit{since: time.Now()}
+			openCircuit(c, config)
+			if c.allow(config) {
+				t.Fatalf("request is allowed when the circuit is open")
+			}
+
+			time.Sleep(config.OpenTime)
+			for i := 0; i < config.Probes; i++ {
+				if !c.allow(config) {
+					t.Fatalf("probe %d isn't allowed", i)
+				}
+			}
+			if c.allow(config) {
+				t.Fatalf("more probes than %d are allowed", config.Probes)
+			}
+
+			tt.probe(c)
+			time.Sleep(tt.wait)
+			if allow := c.allow(config); allow != tt.allow {
+				t.Fatalf("allow = %v, want %v", allow, tt.allow)
+			}
+			if c.state != tt.state {
+				t.Fatalf("state = %d, want %d", c.state, tt.state)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerForget(t *testing.T) {
+	b := NewCircuitBreaker(BreakerConfig{})
+	e := &endpointBreaker{breaker: b, service: "my-service", config: b.config}
+	e.record("127.0.0.1:8000", status.Error(codes.Unavailable, "down"), 0)
+	e.record("127.0.0.1:8001", errors.New("failed"), 0)
+
+	b.forget("my-service", "127.0.0.1:8000")
+	if _, ok := b.circuits["my-service@127.0.0.1:8000"]; ok {
+		t.Fatalf("circuit of the removed endpoint isn't forgotten")
+	}
+	if _, ok := b.circuits["my-service@127.0.0.1:8001"]; !ok {
+		t.Fatalf("circuit of the other endpoint is forgotten")
+	}
+}
@@ -0,0 +1,158 @@
+package balancer
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+
+	grpcbalancer "google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// Config defines the config of the balancers in service config, e.g.
+//
+//	{"loadBalancingConfig": [{"least_request": {"choiceCount": 2}}]}
+type Config struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	ChoiceCount int    `json:"choiceCount,omitempty"` // the number of the random choices for least_request
+	HashKey     string `json:"hashKey,omitempty"`     // the metadata key of the request for ring_hash
+
+	OutlierDetection *OutlierDetection `json:"outlierDetection,omitempty"` // the outlier detection config
+}
+
+// the state of a client connection shared by the balancer and its pickers, the pickers read
+// the latest state when picking, since they're not rebuilt when only the state is changed
+type connState struct {
+	mu       sync.RWMutex
+	split    Split                  // the traffic split policy
+	locality *localityPolicy        // the locality of the client
+	weights  [localityDistances]int // the total weight of the endpoints by the distance
+	config   *Config                // the balancer config from service config
+}
+
+// update the state with the client connection state
+func (s *connState) update(state grpcbalancer.ClientConnState) {
+	split := stateSplit(state.ResolverState)
+	locality, weights := stateLocality(state.ResolverState)
+	config, _ := state.BalancerConfig.(*Config)
+	if config == nil {
+		config = &Config{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.split = split
+	s.locality, s.weights = locality, weights
+	s.config = config
+}
+
+// Config returns the current balancer config
+func (s *connState) Config() *Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.config == nil {
+		return &Config{}
+	}
+	return s.config
+}
+
+// Split returns the current traffic split policy
+func (s *connState) Split() Split {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.split
+}
+
+// Locality returns the locality policy of the client, and the total weight of the endpoints
+// by the distance from the client
+func (s *connState) Locality() (*localityPolicy, [localityDistances]int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.locality, s.weights
+}
+
+// balancer builder implements interface 'Builder', it wraps the base balancer builder
+// with a picker builder and an outlier detector for each client connection
+type builder struct {
+	name   string                                      // the name of the balancer
+	picker func(state *connState) base.V2PickerBuilder // new a picker builder for the client connection
+}
+
+// newBuilder returns a balancer builder with the name and the picker builder
+func newBuilder(name string, picker func(state *connState) base.V2PickerBuilder) grpcbalancer.Builder {
+	return &builder{name: name, picker: picker}
+}
+
+// Build creates a balancer for the client connection
+func (b *builder) Build(cc grpcbalancer.ClientConn, opts grpcbalancer.BuildOptions) grpcbalancer.Balancer {
+	state := &connState{}
+	detector := newOutlierDetector(cc, b.picker(state), state)
+	bb := base.NewBalancerBuilderV2(b.name, detector, base.Config{HealthCheck: true})
+
+	// only the weighted pickers honour the traffic split policy
+	split := false
+	switch detector.builder.(type) {
+	case *wrrPickerBuilder, *localityPickerBuilder:
+		split = true
+	}
+
+	return &stateBalancer{
+		v2Balancer: bb.Build(detector, opts).(v2Balancer),
+		name:       b.name,
+		target:     opts.Target.Endpoint,
+		split:      split,
+		state:      state,
+		detector:   detector,
+	}
+}
+
+// Name returns the name of the balancer
+func (b *builder) Name() string {
+	return b.name
+}
+
+// ParseConfig parses the balancer config from service config
+func (b *builder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	config := &Config{}
+	if err := json.Unmarshal(js, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// the base balancer implements both interfaces
+type v2Balancer interface {
+	grpcbalancer.Balancer
+	grpcbalancer.V2Balancer
+}
+
+// the balancer updates the state of the client connection before the base balancer
+type stateBalancer struct {
+	v2Balancer
+	name     string // the name of the balancer
+	target   string // the dial target
+	split    bool   // the traffic split policy is honoured
+	state    *connState
+	detector *outlierDetector
+}
+
+// UpdateClientConnState is called by gRPC when the state of the ClientConn changes
+func (b *stateBalancer) UpdateClientConnState(s grpcbalancer.ClientConnState) error {
+	if split := stateSplit(s.ResolverState); len(split) > 0 && len(b.state.Split()) == 0 && !b.split {
+		log.Printf("balancer {%s} ignores the traffic split policy of {%s}", b.name, b.target)
+	}
+	b.state.update(s)
+	return b.v2Balancer.UpdateClientConnState(s)
+}
+
+// Close the balancer and the outlier detector
+func (b *stateBalancer) Close() {
+	b.detector.close()
+	b.v2Balancer.Close()
+}
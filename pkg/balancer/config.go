@@ -0,0 +1,56 @@
+package balancer
+
+import (
+	"log"
+	"strings"
+
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// ConfigKey - the key of the grpc service config under the service, e.g. '/services/my-service/_config',
+// the value is the service config json, which sets the load balancing policy, retry policy and
+// timeouts for all the clients, e.g.
+//
+//	{"loadBalancingPolicy": "least_request", "methodConfig": [{"name": [{"service": "apis.Greeter"}], "timeout": "1s"}]}
+//
+// The config overrides the default service config of the dial site. Since grpc keeps the last
+// service config when it's not provided any more, the existing connections still use the last
+// config after the key is deleted.
+const ConfigKey = "_config"
+
+// the policies of the service from the reserved keys
+type servicePolicy struct {
+	split  Split                      // the traffic split policy
+	config *serviceconfig.ParseResult // the grpc service config, nil if it's not set
+}
+
+// updatePolicy updates the policy by the reserved key, the value is nil if the key is deleted.
+// The invalid policy is ignored, and the previous one is kept.
+func (s *etcdResolver) updatePolicy(policy *servicePolicy, key string, value []byte) bool {
+	switch {
+	case strings.HasSuffix(key, "/"+SplitKey):
+		var split Split
+		if value != nil {
+			var err error
+			if split, err = parseSplit(value); err != nil {
+				log.Printf("parse split {%q}: %v", value, err)
+				return false
+			}
+		}
+		policy.split = split
+
+	case strings.HasSuffix(key, "/"+ConfigKey):
+		var config *serviceconfig.ParseResult
+		if value != nil {
+			if config = s.cc.ParseServiceConfig(string(value)); config.Err != nil {
+				log.Printf("parse service config {%q}: %v", value, config.Err)
+				return false
+			}
+		}
+		policy.config = config
+
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,282 @@
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DNSRefreshInterval - default interval time for resolving the dns records again
+	DNSRefreshInterval = 30
+)
+
+// DNSRegistry implements interface 'Registry' by resolving the service name through the
+// dns SRV records '_grpc._tcp.<name>.<domain>', and falling back to the A/AAAA records
+// of '<name>.<domain>' with the default port. The records are resolved periodly, and the
+// changes are delivered to the watchers like the etcd prefix watch.
+type DNSRegistry struct {
+	resolver *net.Resolver // the dns resolver
+	domain   string        // the domain appended to the service name
+	port     string        // the default port for the A/AAAA records
+	interval time.Duration // the interval time for resolving the records again
+	opts     *options      // the options for the service keys
+	done     chan struct{} // notify exit
+}
+
+// NewDNSRegistry returns a registry based on dns, the nameserver is 'host:port' of the
+// dns server, or empty for the system resolver
+func NewDNSRegistry(nameserver string, domain string, port string, opts ...Option) *DNSRegistry {
+	r := net.DefaultResolver
+	if nameserver != "" {
+		r = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, nameserver)
+			},
+		}
+	}
+
+	return &DNSRegistry{
+		resolver: r,
+		domain:   strings.Trim(domain, "."),
+		port:     port,
+		interval: time.Second * DNSRefreshInterval,
+		opts:     newOptions(opts...),
+		done:     make(chan struct{}),
+	}
+}
+
+// Register isn't supported by the dns registry
+func (s *DNSRegistry) Register(ctx context.Context, key string, value string, ttl int64) (Lease, error) {
+	return nil, ErrReadOnlyRegistry
+}
+
+// Deregister isn't supported by the dns registry
+func (s *DNSRegistry) Deregister(ctx context.Context, key string) error {
+	return ErrReadOnlyRegistry
+}
+
+// List resolves the service name in the prefix, and returns the key and values, the dns
+// records have no revision, so the hash of the records is returned as the revision. The
+// subtree of the services can't be listed.
+func (s *DNSRegistry) List(ctx context.Context, prefix string) ([]*KeyValue, int64, error) {
+	kvs, err := s.resolve(ctx, prefix)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	list := make([]*KeyValue, 0, len(kvs))
+	for key, value := range kvs {
+		list = append(list, &KeyValue{Key: key, Value: value})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list, recordsRevision(kvs), nil
+}
+
+// recordsRevision returns the hash of the records as the revision, it's never zero
+func recordsRevision(kvs map[string][]byte) int64 {
+	keys := make([]string, 0, len(kvs))
+	for key := range kvs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h := fnv.New64a()
+	for _, key := range keys {
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write(kvs[key])
+		h.Write([]byte{0})
+	}
+	return int64(h.Sum64()>>1 | 1)
+}
+
+// Watch resolves the service name in the prefix periodly, and delivers the changes. The
+// changes are since the records of the revision returned by 'List', the watch is resynced
+// if the records are changed before they're resolved the first time. The changes are since
+// the watch starts if the revision is zero.
+func (s *DNSRegistry) Watch(ctx context.Context, prefix string, rev int64) <-chan []*Event {
+	eventChan := make(chan []*Event)
+
+	go func() {
+		defer close(eventChan)
+
+		// the records when the watch starts, or unknown until they're compared with the revision
+		var current map[string][]byte
+		if rev == 0 {
+			var err error
+			if current, err = s.resolve(ctx, prefix); err != nil {
+				log.Printf("resolve {%s}: %v", prefix, err)
+			}
+		}
+		known := rev == 0
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+
+			kvs, err := s.resolve(ctx, prefix)
+			if err != nil {
+				log.Printf("resolve {%s}: %v", prefix, err)
+				continue
+			}
+
+			var events []*Event
+			if !known && recordsRevision(kvs) != rev {
+				// the listed records are unknown, the watcher has to list them again
+				events = append(events, &Event{Type: EventResync})
+				select {
+				case eventChan <- events:
+				case <-ctx.Done():
+				case <-s.done:
+				}
+				return
+			}
+			if !known {
+				current, known = kvs, true
+			}
+			for key, value := range current {
+				if _, ok := kvs[key]; !ok {
+					events = append(events, &Event{Type: EventDelete, Kv: &KeyValue{Key: key, Value: value}})
+				}
+			}
+			for key, value := range kvs {
+				if prev, ok := current[key]; !ok || string(prev) != string(value) {
+					events = append(events, &Event{Type: EventPut, Kv: &KeyValue{Key: key, Value: value}})
+				}
+			}
+			current = kvs
+			if len(events) == 0 {
+				continue
+			}
+
+			select {
+			case eventChan <- events:
+			case <-ctx.Done():
+				return
+			case <-s.done:
+				return
+			}
+		}
+	}()
+
+	return eventChan
+}
+
+// Close the dns registry
+func (s *DNSRegistry) Close() error {
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	return nil
+}
+
+// resolve the service name in the prefix, and returns a service for each address
+func (s *DNSRegistry) resolve(ctx context.Context, prefix string) (map[string][]byte, error) {
+	name := strings.Trim(strings.TrimPrefix(prefix, s.opts.namespace+"/"), "/")
+	// only the prefix of a single service with a flat name can be resolved
+	if name == "" || strings.Contains(name, "/") || IsSubtree(ctx) {
+		return nil, nil
+	}
+	host := name
+	if s.domain != "" {
+		host = name + "." + s.domain
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.opts.requestTimeout)
+	defer cancel()
+
+	eps, err := s.lookupSRV(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	// fall back to the A/AAAA records if there is no SRV record
+	if len(eps) == 0 && s.port != "" {
+		if eps, err = s.lookupHost(ctx, host, s.port); err != nil {
+			return nil, err
+		}
+	}
+
+	kvs := make(map[string][]byte)
+	for _, ep := range eps {
+		service := &Service{
+			ID:        "dns-" + net.JoinHostPort(ep.IP, ep.Port),
+			Name:      name,
+			Endpoints: []Endpoint{ep},
+		}
+		body, err := json.Marshal(service)
+		if err != nil {
+			return nil, err
+		}
+		kvs[s.opts.serviceKey(service)] = body
+	}
+	return kvs, nil
+}
+
+// lookupSRV resolves the SRV records of the host, and the addresses of the targets
+func (s *DNSRegistry) lookupSRV(ctx context.Context, host string) ([]Endpoint, error) {
+	_, srvs, err := s.resolver.LookupSRV(ctx, "grpc", "tcp", host)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var eps []Endpoint
+	for _, srv := range srvs {
+		targets, err := s.lookupHost(ctx, srv.Target, strconv.Itoa(int(srv.Port)))
+		if err != nil {
+			return nil, err
+		}
+		eps = append(eps, targets...)
+	}
+	return eps, nil
+}
+
+// lookupHost resolves the A/AAAA records of the host
+func (s *DNSRegistry) lookupHost(ctx context.Context, host string, port string) ([]Endpoint, error) {
+	addrs, err := s.resolver.LookupIPAddr(ctx, host)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	eps := make([]Endpoint, 0, len(addrs))
+	for _, addr := range addrs {
+		eps = append(eps, Endpoint{
+			IP:       addr.IP.String(),
+			Port:     port,
+			Protocol: "GRPC",
+		})
+	}
+	return eps, nil
+}
+
+// isNotFound checks if the dns error is that the host isn't found
+func isNotFound(err error) bool {
+	if dnsErr, ok := err.(*net.DNSError); ok {
+		return dnsErr.IsNotFound
+	}
+	return false
+}
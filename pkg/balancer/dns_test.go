@@ -0,0 +1,236 @@
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// test dns server answers the SRV, A and AAAA records in the zone
+type testDNSServer struct {
+	conn net.PacketConn
+	mu   sync.Mutex
+	srv  map[string][]dnsmessage.SRVResource  // the SRV records by name
+	a    map[string][]dnsmessage.AResource    // the A records by name
+	aaaa map[string][]dnsmessage.AAAAResource // the AAAA records by name
+}
+
+// startDNSServer starts the dns server on a local udp port
+func startDNSServer(t *testing.T, s *testDNSServer) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.conn = conn
+	go s.serve()
+
+	return conn.LocalAddr().String()
+}
+
+func (s *testDNSServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		var req dnsmessage.Message
+		if err := req.Unpack(buf[:n]); err != nil || len(req.Questions) == 0 {
+			continue
+		}
+		res := s.answer(req)
+		if b, err := res.Pack(); err == nil {
+			s.conn.WriteTo(b, addr)
+		}
+	}
+}
+
+// answer the question, the name without any record isn't found
+func (s *testDNSServer) answer(req dnsmessage.Message) dnsmessage.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := req.Questions[0]
+	name := q.Name.String()
+	res := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: req.ID, Response: true, Authoritative: true},
+		Questions: req.Questions,
+	}
+	header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: 60}
+
+	if s.srv[name] == nil && s.a[name] == nil && s.aaaa[name] == nil {
+		res.RCode = dnsmessage.RCodeNameError
+		return res
+	}
+	switch q.Type {
+	case dnsmessage.TypeSRV:
+		for _, r := range s.srv[name] {
+			r := r
+			res.Answers = append(res.Answers, dnsmessage.Resource{Header: header, Body: &r})
+		}
+	case dnsmessage.TypeA:
+		for _, r := range s.a[name] {
+			r := r
+			res.Answers = append(res.Answers, dnsmessage.Resource{Header: header, Body: &r})
+		}
+	case dnsmessage.TypeAAAA:
+		for _, r := range s.aaaa[name] {
+			r := r
+			res.Answers = append(res.Answers, dnsmessage.Resource{Header: header, Body: &r})
+		}
+	}
+	return res
+}
+
+func TestDNSRegistry(t *testing.T) {
+	server := &testDNSServer{
+		srv: map[string][]dnsmessage.SRVResource{
+			"_grpc._tcp.my-service.example.com.": {
+				{Target: dnsmessage.MustNewName("node1.example.com."), Port: 8000},
+			},
+		},
+		a: map[string][]dnsmessage.AResource{
+			"node1.example.com.": {{A: [4]byte{127, 0, 0, 1}}},
+		},
+		aaaa: map[string][]dnsmessage.AAAAResource{
+			"legacy.example.com.": {{AAAA: [16]byte{15: 1}}},
+		},
+	}
+	nameserver := startDNSServer(t, server)
+	defer server.conn.Close()
+
+	registry := NewDNSRegistry(nameserver, "example.com", "15001")
+	defer registry.Close()
+
+	tests := []struct {
+		name   string
+		target string
+		addrs  []string
+	}{
+		{name: "SRV records", target: "my-service", addrs: []string{"127.0.0.1:8000"}},
+		{name: "AAAA records with the default port", target: "legacy", addrs: []string{"[::1]:15001"}},
+		{name: "unknown service", target: "unknown", addrs: nil},
+		{name: "subtree of the services", target: "my-service/*", addrs: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			prefix, subtree := servicePrefix("/"+scheme, tt.target)
+			if subtree {
+				ctx = WithSubtree(ctx)
+			}
+			kvs, _, err := registry.List(ctx, prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(kvs) != len(tt.addrs) {
+				t.Fatalf("got %d instances, want %d", len(kvs), len(tt.addrs))
+			}
+			for _, kv := range kvs {
+				var service Service
+				if err := json.Unmarshal(kv.Value, &service); err != nil {
+					t.Fatal(err)
+				}
+				if "/"+scheme+"/"+service.Name+"/" != prefix {
+					t.Fatalf("service name = %s, want %s", service.Name, tt.target)
+				}
+			}
+
+			r, cc := buildResolver(t, registry, tt.target)
+			defer r.Close()
+			cc.waitAddrs(t, tt.addrs...)
+		})
+	}
+}
+
+func TestDNSRegistryWatch(t *testing.T) {
+	srv := func(port uint16) []dnsmessage.SRVResource {
+		return []dnsmessage.SRVResource{{Target: dnsmessage.MustNewName("node1.example.com."), Port: port}}
+	}
+
+	tests := []struct {
+		name     string
+		registry func(dns *DNSRegistry) Registry
+		changed  bool // the records are changed between listing and watching
+	}{
+		{
+			name:     "records unchanged since listing",
+			registry: func(dns *DNSRegistry) Registry { return dns },
+		},
+		{
+			name:     "records changed since listing",
+			registry: func(dns *DNSRegistry) Registry { return dns },
+			changed:  true,
+		},
+		{
+			name:     "records changed since listing by the combined registries",
+			registry: func(dns *DNSRegistry) Registry { return NewMultiRegistry(NewMemoryRegistry(), dns) },
+			changed:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &testDNSServer{
+				srv: map[string][]dnsmessage.SRVResource{"_grpc._tcp.my-service.example.com.": srv(8000)},
+				a:   map[string][]dnsmessage.AResource{"node1.example.com.": {{A: [4]byte{127, 0, 0, 1}}}},
+			}
+			nameserver := startDNSServer(t, server)
+			defer server.conn.Close()
+
+			dns := NewDNSRegistry(nameserver, "example.com", "")
+			dns.interval = time.Millisecond * 50
+			registry := tt.registry(dns)
+			defer registry.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			prefix, _ := servicePrefix("/"+scheme, "my-service")
+			_, rev, err := registry.List(ctx, prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			change := func() {
+				server.mu.Lock()
+				server.srv["_grpc._tcp.my-service.example.com."] = srv(8001)
+				server.mu.Unlock()
+			}
+			if tt.changed {
+				change()
+			}
+			eventChan := registry.Watch(ctx, prefix, rev)
+			if !tt.changed {
+				// the change is delivered after the records are resolved the first time
+				time.Sleep(time.Millisecond * 200)
+				change()
+			}
+
+			var events []*Event
+			select {
+			case events = <-eventChan:
+			case <-time.After(time.Second * 2):
+				t.Fatalf("no event is delivered")
+			}
+			types := make(map[EventType]int)
+			for _, event := range events {
+				types[event.Type]++
+			}
+			if tt.changed && (len(events) != 1 || types[EventResync] != 1) {
+				t.Fatalf("got %d events %v, want resync", len(events), types)
+			}
+			if !tt.changed && (len(events) != 2 || types[EventDelete] != 1 || types[EventPut] != 1) {
+				t.Fatalf("got %d events %v, want a delete and a put", len(events), types)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package balancer
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"google.golang.org/grpc"
+	grpcbackoff "google.golang.org/grpc/backoff"
+)
+
+// etcd registry implements interface 'Registry'
+type etcdRegistry struct {
+	client *clientv3.Client // the etcd client
+}
+
+// NewEtcdRegistry returns a registry based on etcd, the addr is separated by ';'. It doesn't
+// wait for the connection, so that the registry can be created when etcd is unavailable,
+// and the requests fail until connected.
+func NewEtcdRegistry(addr string, opts ...Option) (Registry, error) {
+	o := newOptions(opts...)
+
+	// new a etcd client which based on grpc protocol, each dialling is limited by the timeout
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints: strings.Split(addr, ";"),
+		DialOptions: []grpc.DialOption{
+			grpc.WithConnectParams(grpc.ConnectParams{
+				Backoff:           grpcbackoff.DefaultConfig,
+				MinConnectTimeout: o.dialTimeout,
+			}),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &etcdRegistry{client: client}, nil
+}
+
+// etcd lease implements interface 'Lease', it consumes the keepalive responses
+// and notices immediately when the lease is expired or revoked
+type etcdLease struct {
+	client *clientv3.Client   // the etcd client
+	id     clientv3.LeaseID   // the lease id
+	cancel context.CancelFunc // stop keeping the lease alive
+	done   chan struct{}      // notify the lease is lost
+
+	mu      sync.RWMutex
+	ttl     int64     // the ttl seconds from the last keepalive response
+	renewed time.Time // the time of the last keepalive response
+}
+
+// Register puts the key into etcd with a new lease, and keeps the lease alive
+func (s *etcdRegistry) Register(ctx context.Context, key string, value string, ttl int64) (Lease, error) {
+	// Grant creates a new lease.
+	lease, err := s.client.Grant(ctx, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	// put the key into etcd registry
+	res, err := s.client.Put(ctx, key, value, clientv3.WithLease(lease.ID))
+	if err != nil {
+		// revoke the useless lease in the background
+		go s.client.Revoke(context.Background(), lease.ID)
+		return nil, err
+	}
+	log.Printf("Put key {%s} with lease {%x}, revision: {%v}", key, lease.ID, res.Header.Revision)
+
+	// KeepAlive keeps the given lease alive until the context is canceled
+	keepaliveCtx, cancel := context.WithCancel(context.Background())
+	keepaliveChan, err := s.client.KeepAlive(keepaliveCtx, lease.ID)
+	if err != nil {
+		cancel()
+		go s.client.Revoke(context.Background(), lease.ID)
+		return nil, err
+	}
+
+	l := &etcdLease{
+		client:  s.client,
+		id:      lease.ID,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		ttl:     lease.TTL,
+		renewed: time.Now(),
+	}
+	go l.keepalive(keepaliveCtx, keepaliveChan)
+
+	return l, nil
+}
+
+// consume the keepalive responses until the channel is closed, which means the lease
+// is expired, revoked, or the keepalive is halted
+func (l *etcdLease) keepalive(ctx context.Context, keepaliveChan <-chan *clientv3.LeaseKeepAliveResponse) {
+	defer close(l.done)
+
+	for res := range keepaliveChan {
+		l.mu.Lock()
+		l.ttl = res.TTL
+		l.renewed = time.Now()
+		l.mu.Unlock()
+	}
+	if ctx.Err() == nil {
+		log.Printf("lease {%x} is lost", l.id)
+	}
+}
+
+// State returns the current state of the lease
+func (l *etcdLease) State() LeaseState {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	remaining := time.Second*time.Duration(l.ttl) - time.Since(l.renewed)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return LeaseState{
+		ID:          int64(l.id),
+		TTL:         remaining,
+		LastRenewal: l.renewed,
+	}
+}
+
+// Done returns a channel which is closed when the lease is lost
+func (l *etcdLease) Done() <-chan struct{} {
+	return l.done
+}
+
+// Revoke the lease, the key bound to the lease is deleted
+func (l *etcdLease) Revoke(ctx context.Context) error {
+	// stop keeping the lease alive first
+	l.cancel()
+
+	if _, err := l.client.Revoke(ctx, l.id); err != nil {
+		return err
+	}
+	log.Printf("lease {%x} is revoked", l.id)
+
+	return nil
+}
+
+// Deregister deletes the key from etcd
+func (s *etcdRegistry) Deregister(ctx context.Context, key string) error {
+	res, err := s.client.Delete(ctx, key)
+	if err != nil {
+		return err
+	}
+	log.Printf("key {%s} is deleted -> %v", key, (res.Deleted == 1))
+
+	return nil
+}
+
+// List returns the key and values with the prefix from etcd, and the revision of the response
+func (s *etcdRegistry) List(ctx context.Context, prefix string) ([]*KeyValue, int64, error) {
+	res, err := s.client.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	kvs := make([]*KeyValue, 0, len(res.Kvs))
+	for _, item := range res.Kvs {
+		kvs = append(kvs, &KeyValue{Key: string(item.Key), Value: item.Value})
+	}
+	return kvs, res.Header.Revision, nil
+}
+
+// Watch the changes of the keys with the prefix from etcd after the revision. The watch is
+// resumed from the last seen revision when it's broken, and the resync event is delivered
+// if the revision is compacted, since the changes in between are lost.
+func (s *etcdRegistry) Watch(ctx context.Context, prefix string, rev int64) <-chan []*Event {
+	eventChan := make(chan []*Event)
+
+	go func() {
+		defer close(eventChan)
+
+		for retries := 0; ; retries++ {
+			opts := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithPrevKV()}
+			if rev > 0 {
+				opts = append(opts, clientv3.WithRev(rev+1))
+			}
+
+			watchChan := s.client.Watch(ctx, prefix, opts...)
+			for data := range watchChan {
+				if data.CompactRevision > 0 {
+					log.Printf("watch {%s} from revision {%d}: compacted at {%d}", prefix, rev+1, data.CompactRevision)
+					select {
+					case eventChan <- []*Event{{Type: EventResync}}:
+					case <-ctx.Done():
+					}
+					return
+				}
+				if err := data.Err(); err != nil {
+					log.Printf("watch {%s}: %v", prefix, err)
+					break
+				}
+				retries = 0
+
+				var events []*Event
+				for _, event := range data.Events {
+					// resume from the revision of the last event
+					if event.Kv != nil {
+						rev = event.Kv.ModRevision
+					}
+
+					switch event.Type {
+					case mvccpb.PUT:
+						// for the addition event, the kv should not be empty
+						if event.Kv == nil {
+							log.Printf("current kv is nil for addition")
+							continue
+						}
+						events = append(events, &Event{
+							Type: EventPut,
+							Kv:   &KeyValue{Key: string(event.Kv.Key), Value: event.Kv.Value},
+						})
+
+					case mvccpb.DELETE:
+						// for the delete event, the prev kv should not be empty
+						if event.PrevKv == nil {
+							log.Printf("previous kv is nil for deletion")
+							continue
+						}
+						events = append(events, &Event{
+							Type: EventDelete,
+							Kv:   &KeyValue{Key: string(event.PrevKv.Key), Value: event.PrevKv.Value},
+						})
+					}
+				}
+				if len(events) == 0 {
+					continue
+				}
+
+				select {
+				case eventChan <- events:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			// the watch channel is closed when the context is done or the client is closed,
+			// otherwise it's broken and resumed after a while
+			if ctx.Err() != nil || s.client.Ctx().Err() != nil {
+				return
+			}
+			select {
+			case <-time.After(backoff(retries, time.Second, time.Second*EtcdWatchRetryInterval)):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return eventChan
+}
+
+// Close the etcd client
+func (s *etcdRegistry) Close() error {
+	return s.client.Close()
+}
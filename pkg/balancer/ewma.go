@@ -0,0 +1,162 @@
+package balancer
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	grpcbalancer "google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+const (
+	// PeakEWMA - the name of the latency aware balancer
+	PeakEWMA = "peak_ewma"
+	// EWMADecay - the decay time of the moving average, the older samples have less weight
+	EWMADecay = time.Second * 10
+	// EWMAErrorPenalty - the score of the peer is multiplied by it for the error rate 100%
+	EWMAErrorPenalty = 10
+)
+
+func init() {
+	grpcbalancer.Register(newBuilder(PeakEWMA, func(state *connState) base.V2PickerBuilder {
+		return &ewmaPickerBuilder{stats: make(map[grpcbalancer.SubConn]*ewmaStats)}
+	}))
+}
+
+// the moving averages of the latency and error rate for a peer
+type ewmaStats struct {
+	mu       sync.Mutex
+	latency  float64   // the average latency in nanoseconds
+	errRate  float64   // the average error rate between 0 and 1
+	inflight int       // the number of in-flight requests
+	updated  time.Time // the time of the last sample
+}
+
+// score returns the cost of sending a request to the peer, the lower is the better. The peer
+// without any sample is scored by the in-flight requests only, so that it's tried soon. The
+// averages are decayed since the last sample, so that the slow peer is tried again later.
+func (s *ewmaStats) score() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w := math.Exp(-float64(time.Since(s.updated)) / float64(EWMADecay))
+	return (s.latency*w + 1) * float64(s.inflight+1) * (1 + s.errRate*w*(EWMAErrorPenalty-1))
+}
+
+// start a request to the peer
+func (s *ewmaStats) start() {
+	s.mu.Lock()
+	s.inflight++
+	s.mu.Unlock()
+}
+
+// release the request which isn't sent to the peer, e.g. the pick is skipped for the open
+// circuit of the endpoint, it isn't a sample of the latency and error
+func (s *ewmaStats) release() {
+	s.mu.Lock()
+	s.inflight--
+	s.mu.Unlock()
+}
+
+// finish the request with the latency and error, the averages are decayed by the time since
+// the last sample. The latency is peak sensitive, the higher latency is taken immediately.
+func (s *ewmaStats) finish(latency time.Duration, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inflight--
+
+	now := time.Now()
+	w := math.Exp(-float64(now.Sub(s.updated)) / float64(EWMADecay))
+	if s.updated.IsZero() {
+		w = 0
+	}
+	s.updated = now
+
+	if sample := float64(latency); sample > s.latency {
+		s.latency = sample
+	} else {
+		s.latency = s.latency*w + sample*(1-w)
+	}
+
+	var sample float64
+	if failed {
+		sample = 1
+	}
+	s.errRate = s.errRate*w + sample*(1-w)
+}
+
+// latency aware picker builder implements interface 'V2PickerBuilder', it keeps the stats of
+// the subconns, since the pickers are rebuilt when any subconn is changed
+type ewmaPickerBuilder struct {
+	mu    sync.Mutex
+	stats map[grpcbalancer.SubConn]*ewmaStats // the stats of the subconns
+}
+
+// Build returns a latency aware picker with the ready subconns
+func (b *ewmaPickerBuilder) Build(info base.PickerBuildInfo) grpcbalancer.V2Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPickerV2(grpcbalancer.ErrNoSubConnAvailable)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// drop the stats of the removed subconns
+	stats := make(map[grpcbalancer.SubConn]*ewmaStats, len(info.ReadySCs))
+	picker := &ewmaPicker{}
+	for sc := range info.ReadySCs {
+		s, ok := b.stats[sc]
+		if !ok {
+			s = &ewmaStats{}
+		}
+		stats[sc] = s
+		picker.peers = append(picker.peers, &ewmaPeer{subConn: sc, stats: s})
+	}
+	b.stats = stats
+
+	return picker
+}
+
+// the peer with the stats
+type ewmaPeer struct {
+	subConn grpcbalancer.SubConn
+	stats   *ewmaStats
+}
+
+// latency aware picker implements interface 'V2Picker', it picks the peer with the lower score
+// from two random choices, the score is based on the moving averages of the latency and error
+// rate, and the in-flight requests
+type ewmaPicker struct {
+	peers []*ewmaPeer // the ready peers
+}
+
+// Pick the peer with the lower score from two random choices
+func (p *ewmaPicker) Pick(info grpcbalancer.PickInfo) (grpcbalancer.PickResult, error) {
+	best := p.peers[rand.Intn(len(p.peers))]
+	if len(p.peers) > 1 {
+		// choose another peer different from the first one
+		i := rand.Intn(len(p.peers) - 1)
+		if p.peers[i] == best {
+			i = len(p.peers) - 1
+		}
+		if peer := p.peers[i]; peer.stats.score() < best.stats.score() {
+			best = peer
+		}
+	}
+
+	best.stats.start()
+	start := time.Now()
+	return grpcbalancer.PickResult{
+		SubConn: best.subConn,
+		Done: func(info grpcbalancer.DoneInfo) {
+			if info.Err == ErrCircuitOpen {
+				best.stats.release()
+				return
+			}
+			best.stats.finish(time.Since(start), info.Err != nil)
+		},
+	}, nil
+}
@@ -0,0 +1,87 @@
+package balancer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	grpcbalancer "google.golang.org/grpc/balancer"
+)
+
+// sample a finished request of the peer
+func sample(s *ewmaStats, latency time.Duration, failed bool) {
+	s.start()
+	s.finish(latency, failed)
+}
+
+func TestEWMAPick(t *testing.T) {
+	tests := []struct {
+		name   string
+		finish func(first, second *ewmaStats) // finish the requests before picking
+		min    int                            // the min picks of the first peer in 100
+		max    int                            // the max picks of the first peer in 100
+	}{
+		{
+			name: "slow peer",
+			finish: func(first, second *ewmaStats) {
+				for i := 0; i < 3; i++ {
+					sample(first, time.Millisecond*100, false)
+					sample(second, time.Millisecond, false)
+				}
+			},
+			max: 5,
+		},
+		{
+			name: "failing peer",
+			finish: func(first, second *ewmaStats) {
+				for i := 0; i < 3; i++ {
+					sample(first, time.Millisecond, true)
+					sample(second, time.Millisecond*2, false)
+				}
+			},
+			max: 5,
+		},
+		{
+			name: "slow peer is tried again after the decay",
+			finish: func(first, second *ewmaStats) {
+				sample(first, time.Millisecond*100, false)
+				first.updated = first.updated.Add(-EWMADecay * 10)
+				sample(second, time.Millisecond, false)
+			},
+			min: 1,
+			max: 100,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := &ewmaPickerBuilder{stats: make(map[grpcbalancer.SubConn]*ewmaStats)}
+			picker := builder.Build(readySubConns(Endpoint{IP: "127.0.0.1", Port: "8000"}, Endpoint{IP: "127.0.0.1", Port: "8001"}))
+
+			var first, second *ewmaStats
+			for sc, stats := range builder.stats {
+				if sc.(*testSubConn).addr == "127.0.0.1:8000" {
+					first = stats
+				} else {
+					second = stats
+				}
+			}
+			tt.finish(first, second)
+
+			picked := 0
+			for i := 0; i < 100; i++ {
+				result, err := picker.Pick(grpcbalancer.PickInfo{Ctx: context.Background()})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if result.SubConn.(*testSubConn).addr == "127.0.0.1:8000" {
+					picked++
+				}
+				result.Done(grpcbalancer.DoneInfo{})
+			}
+			if picked < tt.min || picked > tt.max {
+				t.Fatalf("first peer is picked %d times, want [%d, %d]", picked, tt.min, tt.max)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// FileReloadInterval - default interval time for checking if the files are changed
+	FileReloadInterval = 1
+)
+
+var (
+	// ErrReadOnlyRegistry - the registry doesn't support registering
+	ErrReadOnlyRegistry = errors.New("registry is read only")
+)
+
+// FileRegistry implements interface 'Registry' with the services from a directory or a
+// single file, which is in JSON or YAML format. The files are reloaded when changed, and
+// the add/remove events are delivered to the watchers like the etcd prefix watch.
+type FileRegistry struct {
+	path  string          // the directory or the file path
+	opts  *options        // the options for the service keys
+	store *MemoryRegistry // the current services loaded from the files
+	stamp string          // the stamp of the files loaded last time
+	done  chan struct{}   // notify exit
+}
+
+// NewFileRegistry returns a registry based on the directory or the file path
+func NewFileRegistry(path string, opts ...Option) (*FileRegistry, error) {
+	s := &FileRegistry{
+		path:  path,
+		opts:  newOptions(opts...),
+		store: NewMemoryRegistry(),
+		done:  make(chan struct{}),
+	}
+
+	// load the services once before starting the timer
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	go s.run()
+
+	return s, nil
+}
+
+// Register isn't supported by the file registry
+func (s *FileRegistry) Register(ctx context.Context, key string, value string, ttl int64) (Lease, error) {
+	return nil, ErrReadOnlyRegistry
+}
+
+// Deregister isn't supported by the file registry
+func (s *FileRegistry) Deregister(ctx context.Context, key string) error {
+	return ErrReadOnlyRegistry
+}
+
+// List returns the key and values with the prefix
+func (s *FileRegistry) List(ctx context.Context, prefix string) ([]*KeyValue, int64, error) {
+	return s.store.List(ctx, prefix)
+}
+
+// Watch the changes of the keys with the prefix
+func (s *FileRegistry) Watch(ctx context.Context, prefix string, rev int64) <-chan []*Event {
+	return s.store.Watch(ctx, prefix, rev)
+}
+
+// Close the file registry
+func (s *FileRegistry) Close() error {
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	return s.store.Close()
+}
+
+// reload the files periodly
+func (s *FileRegistry) run() {
+	ticker := time.NewTicker(time.Second * FileReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.reload(); err != nil {
+				log.Printf("reload {%s}: %v", s.path, err)
+			}
+		}
+	}
+}
+
+// reload the files if changed, and apply the differences to the store
+func (s *FileRegistry) reload() error {
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+
+	stamp, err := fileStamp(files)
+	if err != nil {
+		return err
+	}
+	if stamp == s.stamp {
+		return nil
+	}
+
+	// parse all the files before applying, keep the previous services on error
+	kvs := make(map[string][]byte)
+	for _, file := range files {
+		services, err := parseServiceFile(file)
+		if err != nil {
+			return fmt.Errorf("parse {%s}: %v", file, err)
+		}
+		for _, service := range services {
+			body, err := json.Marshal(service)
+			if err != nil {
+				return err
+			}
+			kvs[s.opts.serviceKey(service)] = body
+		}
+	}
+	s.stamp = stamp
+
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+
+	for key := range s.store.items {
+		if _, ok := kvs[key]; !ok {
+			s.store.delete(key)
+		}
+	}
+	for key, value := range kvs {
+		if item, ok := s.store.items[key]; ok && string(item.value) == string(value) {
+			continue
+		}
+		s.store.put(key, value, nil)
+	}
+	return nil
+}
+
+// files returns the service files, sorted by name
+func (s *FileRegistry) files() ([]string, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{s.path}, nil
+	}
+
+	infos, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(info.Name())) {
+		case ".json", ".yaml", ".yml":
+			files = append(files, filepath.Join(s.path, info.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// fileStamp returns a stamp with the names, sizes and modification times of the files
+func fileStamp(files []string) (string, error) {
+	var b strings.Builder
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%s:%d:%d;", file, info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
+
+// parseServiceFile parses a service or a list of services from the JSON or YAML file
+func parseServiceFile(file string) ([]*Service, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	unmarshal := json.Unmarshal
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		unmarshal = yaml.Unmarshal
+	}
+
+	var services []*Service
+	// the file contains a list of services, or a single service
+	if err := unmarshal(data, &services); err != nil {
+		var service Service
+		if err := unmarshal(data, &service); err != nil {
+			return nil, err
+		}
+		services = []*Service{&service}
+	}
+
+	for _, service := range services {
+		if service.Name == "" || service.ID == "" {
+			return nil, errors.New("service name and id should not be empty")
+		}
+	}
+	return services, nil
+}
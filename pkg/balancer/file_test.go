@@ -0,0 +1,189 @@
+package balancer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeFile writes the content to the file in the directory
+func writeFile(t *testing.T, dir string, name string, content string) string {
+	t.Helper()
+
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestFileRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := writeFile(t, dir, "a.json", `{"id": "a", "name": "my-service", "endpoints": [{"ip": "127.0.0.1", "port": "8000"}]}`)
+	writeFile(t, dir, "b.yaml", `
+- id: b
+  name: my-service
+  endpoints:
+  - {ip: 127.0.0.1, port: "8001"}
+- id: a
+  name: other-service
+  endpoints:
+  - {ip: 127.0.0.1, port: "9000"}
+`)
+
+	registry, err := NewFileRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registry.Close()
+
+	r, cc := buildResolver(t, registry, "my-service")
+	defer r.Close()
+	cc.waitAddrs(t, "127.0.0.1:8000", "127.0.0.1:8001")
+
+	// the edited file is reloaded
+	writeFile(t, dir, "a.json", `{"id": "a", "name": "my-service", "endpoints": [{"ip": "127.0.0.1", "port": "8002"}]}`)
+	cc.waitAddrs(t, "127.0.0.1:8001", "127.0.0.1:8002")
+
+	// the previous services are kept when the file can't be parsed
+	writeFile(t, dir, "a.json", `{"id": "a", "name": "my-service", "endpoints": [`)
+	time.Sleep(time.Second*FileReloadInterval + time.Millisecond*500)
+	cc.waitAddrs(t, "127.0.0.1:8001", "127.0.0.1:8002")
+
+	// the services of the removed file are deleted
+	if err := os.Remove(a); err != nil {
+		t.Fatal(err)
+	}
+	cc.waitAddrs(t, "127.0.0.1:8001")
+}
+
+func TestFileRegistryStamp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := `{"id": "a", "name": "my-service", "endpoints": [{"ip": "127.0.0.1", "port": "8000"}]}`
+	file := writeFile(t, dir, "a.json", content)
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the registry isn't reloaded periodly, the files are reloaded by the test
+	registry := &FileRegistry{path: dir, opts: newOptions(), store: NewMemoryRegistry(), done: make(chan struct{})}
+	defer registry.Close()
+	if err := registry.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file isn't parsed again if its size and modification time aren't changed
+	invalid := make([]byte, len(content))
+	for i := range invalid {
+		invalid[i] = '!'
+	}
+	writeFile(t, dir, "a.json", string(invalid))
+	if err := os.Chtimes(file, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.reload(); err != nil {
+		t.Fatalf("unchanged file is reloaded: %v", err)
+	}
+
+	// the changed file is parsed again, and the previous services are kept on error
+	if err := os.Chtimes(file, info.ModTime(), info.ModTime().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.reload(); err == nil {
+		t.Fatalf("invalid file is loaded")
+	}
+	kvs, _, err := registry.List(context.Background(), "/services/my-service/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 1 {
+		t.Fatalf("got %d services after the invalid file, want 1", len(kvs))
+	}
+}
+
+func TestParseServiceFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		ids     []string // the ids of the services, nil if the file is invalid
+	}{
+		{
+			name:    "single service in JSON",
+			file:    "a.json",
+			content: `{"id": "a", "name": "my-service", "endpoints": [{"ip": "127.0.0.1", "port": "8000"}]}`,
+			ids:     []string{"a"},
+		},
+		{
+			name:    "list of services in JSON",
+			file:    "a.json",
+			content: `[{"id": "a", "name": "my-service"}, {"id": "b", "name": "my-service"}]`,
+			ids:     []string{"a", "b"},
+		},
+		{
+			name:    "single service in YAML",
+			file:    "a.yaml",
+			content: "id: a\nname: my-service\nendpoints:\n- {ip: 127.0.0.1, port: \"8000\"}\n",
+			ids:     []string{"a"},
+		},
+		{
+			name:    "list of services in YAML",
+			file:    "a.yml",
+			content: "- {id: a, name: my-service}\n- {id: b, name: my-service}\n",
+			ids:     []string{"a", "b"},
+		},
+		{
+			name:    "service without id",
+			file:    "a.json",
+			content: `{"name": "my-service"}`,
+		},
+		{
+			name:    "invalid JSON",
+			file:    "a.json",
+			content: `{"id": "a", "name": "my-service"`,
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "services")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			services, err := parseServiceFile(writeFile(t, dir, tt.file, tt.content))
+			if tt.ids == nil {
+				if err == nil {
+					t.Fatalf("invalid file is parsed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ids []string
+			for _, service := range services {
+				ids = append(ids, service.ID)
+			}
+			if !equalStrings(ids, tt.ids) {
+				t.Fatalf("ids = %v, want %v", ids, tt.ids)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package balancer
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+
+	grpcbalancer "google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// RingHash - the name of the consistent hash balancer
+	RingHash = "ring_hash"
+	// RingHashKey - default metadata key of the request for hashing
+	RingHashKey = "x-hash-key"
+	// RingHashReplicas - the number of the virtual nodes on the ring for each weight of endpoint
+	RingHashReplicas = 100
+)
+
+func init() {
+	grpcbalancer.Register(newBuilder(RingHash, func(state *connState) base.V2PickerBuilder {
+		return &ringPickerBuilder{state: state}
+	}))
+}
+
+// the context key of the request hash key
+type hashKey struct{}
+
+// WithHashKey returns the context with the hash key, which has priority over the metadata
+// for the consistent hash balancer, so that the requests with the same key go to the same
+// endpoint, e.g. the user id
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKey{}, key)
+}
+
+// hash returns the 64 bits fnv-1a hash of the string mixed by the murmur3 finalizer, the
+// fnv-1a hash of the similar strings like the virtual nodes of an address are close to
+// each other, which clusters the nodes on the ring without mixing
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return fmix64(h.Sum64())
+}
+
+// fmix64 is the 64 bits finalizer of murmur3, it spreads every bit of the input to all bits
+func fmix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// consistent hash picker builder implements interface 'V2PickerBuilder'
+type ringPickerBuilder struct {
+	state *connState // the state of the client connection
+}
+
+// Build returns a consistent hash picker with the ring of the ready subconns. The virtual nodes
+// of the endpoint are placed by its address, so that only the keys of the endpoint are remapped
+// when it joins or leaves.
+func (b *ringPickerBuilder) Build(info base.PickerBuildInfo) grpcbalancer.V2Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPickerV2(grpcbalancer.ErrNoSubConnAvailable)
+	}
+
+	picker := &ringPicker{state: b.state}
+	for sc, sci := range info.ReadySCs {
+		replicas := addressWeight(sci.Address) * RingHashReplicas
+		for i := 0; i < replicas; i++ {
+			picker.ring = append(picker.ring, ringNode{
+				hash:    hash(sci.Address.Addr + "#" + strconv.Itoa(i)),
+				subConn: sc,
+			})
+		}
+	}
+	sort.Slice(picker.ring, func(i, j int) bool {
+		return picker.ring[i].hash < picker.ring[j].hash
+	})
+	return picker
+}
+
+// the virtual node on the ring
+type ringNode struct {
+	hash    uint64
+	subConn grpcbalancer.SubConn
+}
+
+// consistent hash picker implements interface 'V2Picker', it picks the first node clockwise
+// on the ring from the hash of the request key, which is from the context or the metadata.
+// The request without any key is sent to a random node.
+type ringPicker struct {
+	state *connState // the state of the client connection
+	ring  []ringNode // the nodes sorted by the hash
+}
+
+// Pick the node by the hash of the request key
+func (p *ringPicker) Pick(info grpcbalancer.PickInfo) (grpcbalancer.PickResult, error) {
+	key, ok := p.requestKey(info.Ctx)
+	if !ok {
+		return grpcbalancer.PickResult{SubConn: p.ring[rand.Intn(len(p.ring))].subConn}, nil
+	}
+
+	h := hash(key)
+	i := sort.Search(len(p.ring), func(i int) bool {
+		return p.ring[i].hash >= h
+	})
+	if i == len(p.ring) {
+		i = 0
+	}
+	return grpcbalancer.PickResult{SubConn: p.ring[i].subConn}, nil
+}
+
+// requestKey returns the hash key from the context, or from the metadata by the configured key
+func (p *ringPicker) requestKey(ctx context.Context) (string, bool) {
+	if ctx == nil {
+		return "", false
+	}
+	if key, ok := ctx.Value(hashKey{}).(string); ok {
+		return key, true
+	}
+
+	name := p.state.Config().HashKey
+	if name == "" {
+		name = RingHashKey
+	}
+	md, _ := metadata.FromOutgoingContext(ctx)
+	if values := md.Get(name); len(values) > 0 {
+		return values[0], true
+	}
+	return "", false
+}
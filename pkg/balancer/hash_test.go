@@ -0,0 +1,93 @@
+package balancer
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	grpcbalancer "google.golang.org/grpc/balancer"
+)
+
+// pickKeys returns the address picked for each of the keys
+func pickKeys(t *testing.T, picker grpcbalancer.V2Picker, keys int) []string {
+	t.Helper()
+
+	picked := make([]string, keys)
+	for i := range picked {
+		ctx := WithHashKey(context.Background(), "user-"+strconv.Itoa(i))
+		result, err := picker.Pick(grpcbalancer.PickInfo{Ctx: ctx})
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked[i] = result.SubConn.(*testSubConn).addr
+	}
+	return picked
+}
+
+func TestRingDistribution(t *testing.T) {
+	tests := []struct {
+		name    string
+		eps     []Endpoint
+		percent map[string]int // the expected percent of the keys for the endpoints
+	}{
+		{
+			name: "same weight",
+			eps: []Endpoint{
+				{IP: "127.0.0.1", Port: "8000"},
+				{IP: "127.0.0.1", Port: "8001"},
+				{IP: "127.0.0.1", Port: "8002"},
+			},
+			percent: map[string]int{"127.0.0.1:8000": 33, "127.0.0.1:8001": 33, "127.0.0.1:8002": 33},
+		},
+		{
+			name: "different weights",
+			eps: []Endpoint{
+				{IP: "127.0.0.1", Port: "8000", Weight: 3},
+				{IP: "127.0.0.1", Port: "8001", Weight: 1},
+			},
+			percent: map[string]int{"127.0.0.1:8000": 75, "127.0.0.1:8001": 25},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			picker := (&ringPickerBuilder{state: &connState{}}).Build(readySubConns(tt.eps...))
+
+			const keys = 10000
+			picked := make(map[string]int)
+			for _, addr := range pickKeys(t, picker, keys) {
+				picked[addr]++
+			}
+			// the share of each endpoint is within 8 percent of its weight
+			for addr, percent := range tt.percent {
+				if got := picked[addr] * 100 / keys; got < percent-8 || got > percent+8 {
+					t.Fatalf("picked %v, want %v percent", picked, tt.percent)
+				}
+			}
+		})
+	}
+}
+
+func TestRingRemap(t *testing.T) {
+	eps := []Endpoint{
+		{IP: "127.0.0.1", Port: "8000"},
+		{IP: "127.0.0.1", Port: "8001"},
+		{IP: "127.0.0.1", Port: "8002"},
+	}
+	builder := &ringPickerBuilder{state: &connState{}}
+
+	const keys = 1000
+	before := pickKeys(t, builder.Build(readySubConns(eps...)), keys)
+	after := pickKeys(t, builder.Build(readySubConns(eps[:2]...)), keys)
+
+	// only the keys of the departed endpoint are remapped
+	departed := eps[2].IP + ":" + eps[2].Port
+	for i := range before {
+		if before[i] != departed && after[i] != before[i] {
+			t.Fatalf("key %d is remapped from %s to %s", i, before[i], after[i])
+		}
+		if after[i] == departed {
+			t.Fatalf("key %d is mapped to the departed endpoint", i)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package balancer
+
+import (
+	"context"
+	"io"
+	"log"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// RegisterWithHealth registers the service into registry only when the grpc health service
+// reports SERVING for the name, or for the whole server if the name is empty. The service is
+// deleted from registry when it's NOT_SERVING or the health service is unavailable, and it's
+// registered again when recovered. It returns immediately without waiting for the service to
+// be serving, the health is watched in the background until the registration is closed.
+func (s *Registrar) RegisterWithHealth(service *Service, client healthpb.HealthClient, name string) (*Registration, error) {
+	r, err := s.newRegistration(service)
+	if err != nil {
+		return nil, err
+	}
+	r.health = make(chan bool)
+
+	s.mu.Lock()
+	s.registrations[r.key] = r
+	s.mu.Unlock()
+
+	go r.watchHealth(client, name)
+	go r.run()
+
+	return r, nil
+}
+
+// watch the serving status from the health service until the registration is closed, the
+// status is polled by 'Check' if the health service doesn't implement 'Watch'
+func (r *Registration) watchHealth(client healthpb.HealthClient, name string) {
+	request := &healthpb.HealthCheckRequest{Service: name}
+
+	for retries := 0; ; retries++ {
+		stream, err := client.Watch(r.ctx, request)
+		if err == nil {
+			for {
+				var res *healthpb.HealthCheckResponse
+				// the error of the stream is kept to fall back to 'Check' if it's unimplemented
+				res, err = stream.Recv()
+				if err != nil {
+					if err != io.EOF && r.ctx.Err() == nil && status.Code(err) != codes.Unimplemented {
+						log.Printf("watch health of service {%s}: %v", r.key, err)
+					}
+					break
+				}
+				retries = 0
+				if !r.notifyHealth(res.Status == healthpb.HealthCheckResponse_SERVING) {
+					return
+				}
+			}
+		}
+		if status.Code(err) == codes.Unimplemented {
+			log.Printf("health service of {%s} doesn't implement watch, check it every {%s}", r.key, r.opts.interval)
+			r.checkHealth(client, request)
+			return
+		}
+
+		// the health is unknown when the stream is broken
+		if !r.notifyHealth(false) {
+			return
+		}
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(backoff(retries, time.Second*RegisterRetryInterval, r.opts.interval)):
+		}
+	}
+}
+
+// poll the serving status from the health service until the registration is closed
+func (r *Registration) checkHealth(client healthpb.HealthClient, request *healthpb.HealthCheckRequest) {
+	ticker := time.NewTicker(r.opts.interval)
+	defer ticker.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(r.ctx, r.opts.requestTimeout)
+		res, err := client.Check(ctx, request)
+		cancel()
+		if err != nil && r.ctx.Err() == nil {
+			log.Printf("check health of service {%s}: %v", r.key, err)
+		}
+		if !r.notifyHealth(err == nil && res.Status == healthpb.HealthCheckResponse_SERVING) {
+			return
+		}
+
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// notify the keepalive loop of the serving status, returns false if the registration is closed
+func (r *Registration) notifyHealth(serving bool) bool {
+	select {
+	case r.health <- serving:
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
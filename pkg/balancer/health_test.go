@@ -0,0 +1,92 @@
+package balancer
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// test health server counts the checks, and doesn't implement 'Watch' if watch is false
+type testHealthServer struct {
+	*health.Server
+	watch  bool
+	checks int32
+}
+
+func (s *testHealthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	atomic.AddInt32(&s.checks, 1)
+	return s.Server.Check(ctx, req)
+}
+
+func (s *testHealthServer) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	if !s.watch {
+		return status.Error(codes.Unimplemented, "method Watch not implemented")
+	}
+	return s.Server.Watch(req, stream)
+}
+
+func TestRegisterWithHealth(t *testing.T) {
+	tests := []struct {
+		name  string
+		watch bool // whether the health service implements 'Watch'
+	}{
+		{name: "watch the health", watch: true},
+		{name: "check the health without watch", watch: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := &testHealthServer{Server: health.NewServer(), watch: tt.watch}
+			server.SetServingStatus("my-service", healthpb.HealthCheckResponse_NOT_SERVING)
+			s := grpc.NewServer()
+			healthpb.RegisterHealthServer(s, server)
+			go s.Serve(lis)
+			defer s.Stop()
+
+			conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			registry := NewMemoryRegistry()
+			defer registry.Close()
+
+			registrar := NewRegistrar(registry, WithInterval(time.Millisecond*50))
+			service := &Service{ID: "a", Name: "my-service", Endpoints: []Endpoint{{IP: "127.0.0.1", Port: "8000"}}}
+			r, err := registrar.RegisterWithHealth(service, healthpb.NewHealthClient(conn), "my-service")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close(context.Background())
+
+			// the service isn't registered until it's serving
+			time.Sleep(time.Millisecond * 200)
+			waitKey(t, registry, r.Key(), false)
+			server.SetServingStatus("my-service", healthpb.HealthCheckResponse_SERVING)
+			waitKey(t, registry, r.Key(), true)
+
+			// the service is deleted when it's not serving, and registered again when recovered
+			server.SetServingStatus("my-service", healthpb.HealthCheckResponse_NOT_SERVING)
+			waitKey(t, registry, r.Key(), false)
+			server.SetServingStatus("my-service", healthpb.HealthCheckResponse_SERVING)
+			waitKey(t, registry, r.Key(), true)
+
+			if checks := atomic.LoadInt32(&server.checks); (checks == 0) == !tt.watch {
+				t.Fatalf("health is checked %d times, watch = %v", checks, tt.watch)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package balancer
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+
+	grpcbalancer "google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+const (
+	// LeastRequest - the name of the least outstanding requests balancer
+	LeastRequest = "least_request"
+	// LeastRequestChoiceCount - default number of the random choices for the least request balancer
+	LeastRequestChoiceCount = 2
+)
+
+func init() {
+	grpcbalancer.Register(newBuilder(LeastRequest, func(state *connState) base.V2PickerBuilder {
+		return &lrPickerBuilder{state: state, inflight: make(map[grpcbalancer.SubConn]*int64)}
+	}))
+}
+
+// least request picker builder implements interface 'V2PickerBuilder', it keeps the in-flight
+// requests of the subconns, since the pickers are rebuilt when any subconn is changed
+type lrPickerBuilder struct {
+	state *connState // the state of the client connection
+
+	mu       sync.Mutex
+	inflight map[grpcbalancer.SubConn]*int64 // the number of in-flight requests for the subconns
+}
+
+// Build returns a least request picker with the ready subconns
+func (b *lrPickerBuilder) Build(info base.PickerBuildInfo) grpcbalancer.V2Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPickerV2(grpcbalancer.ErrNoSubConnAvailable)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// drop the counters of the removed subconns
+	inflight := make(map[grpcbalancer.SubConn]*int64, len(info.ReadySCs))
+	picker := &lrPicker{state: b.state}
+	for sc := range info.ReadySCs {
+		count, ok := b.inflight[sc]
+		if !ok {
+			count = new(int64)
+		}
+		inflight[sc] = count
+		picker.peers = append(picker.peers, &lrPeer{subConn: sc, inflight: count})
+	}
+	b.inflight = inflight
+
+	return picker
+}
+
+// the peer with the number of in-flight requests
+type lrPeer struct {
+	subConn  grpcbalancer.SubConn
+	inflight *int64
+}
+
+// least request picker implements interface 'V2Picker', it picks the peer with the least
+// in-flight requests from the random choices, which is the power of two choices by default
+type lrPicker struct {
+	state *connState // the state of the client connection
+	peers []*lrPeer  // the ready peers
+}
+
+// Pick the peer with the least in-flight requests from the random choices
+func (p *lrPicker) Pick(info grpcbalancer.PickInfo) (grpcbalancer.PickResult, error) {
+	choices := p.state.Config().ChoiceCount
+	if choices <= 0 {
+		choices = LeastRequestChoiceCount
+	}
+
+	var best *lrPeer
+	for i := 0; i < choices; i++ {
+		peer := p.peers[rand.Intn(len(p.peers))]
+		if best == nil || atomic.LoadInt64(peer.inflight) < atomic.LoadInt64(best.inflight) {
+			best = peer
+		}
+	}
+
+	atomic.AddInt64(best.inflight, 1)
+	return grpcbalancer.PickResult{
+		SubConn: best.subConn,
+		Done: func(grpcbalancer.DoneInfo) {
+			atomic.AddInt64(best.inflight, -1)
+		},
+	}, nil
+}
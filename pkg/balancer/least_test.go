@@ -0,0 +1,66 @@
+package balancer
+
+import (
+	"context"
+	"testing"
+
+	grpcbalancer "google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+// pickInflight picks n times without finishing the requests, and returns the results by address
+func pickInflight(t *testing.T, picker grpcbalancer.V2Picker, n int) map[string][]grpcbalancer.PickResult {
+	t.Helper()
+
+	results := make(map[string][]grpcbalancer.PickResult)
+	for i := 0; i < n; i++ {
+		result, err := picker.Pick(grpcbalancer.PickInfo{Ctx: context.Background()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := result.SubConn.(*testSubConn).addr
+		results[addr] = append(results[addr], result)
+	}
+	return results
+}
+
+func TestLeastRequestPick(t *testing.T) {
+	// the choices cover both peers almost surely
+	state := &connState{config: &Config{ChoiceCount: 20}}
+	builder := &lrPickerBuilder{state: state, inflight: make(map[grpcbalancer.SubConn]*int64)}
+	info := readySubConns(Endpoint{IP: "127.0.0.1", Port: "8000"}, Endpoint{IP: "127.0.0.1", Port: "8001"})
+	picker := builder.Build(info)
+
+	// the in-flight requests are balanced
+	results := pickInflight(t, picker, 10)
+	if len(results["127.0.0.1:8000"]) != 5 || len(results["127.0.0.1:8001"]) != 5 {
+		t.Fatalf("picked %d and %d, want 5 each", len(results["127.0.0.1:8000"]), len(results["127.0.0.1:8001"]))
+	}
+
+	// the peer with fewer in-flight requests is picked
+	for _, result := range results["127.0.0.1:8000"] {
+		result.Done(grpcbalancer.DoneInfo{})
+	}
+	if picked := pickInflight(t, picker, 5); len(picked["127.0.0.1:8000"]) != 5 {
+		t.Fatalf("picked %d of 5 for the idle peer", len(picked["127.0.0.1:8000"]))
+	}
+
+	// the counters are kept when the picker is rebuilt, both peers have 5 in-flight requests
+	picker = builder.Build(info)
+	if picked := pickInflight(t, picker, 10); len(picked["127.0.0.1:8000"]) != 5 {
+		t.Fatalf("picked %d of 10 after rebuilding, want 5", len(picked["127.0.0.1:8000"]))
+	}
+
+	// the counters of the removed subconns are dropped
+	removed := base.PickerBuildInfo{ReadySCs: make(map[grpcbalancer.SubConn]base.SubConnInfo)}
+	for sc, sci := range info.ReadySCs {
+		if sc.(*testSubConn).addr == "127.0.0.1:8001" {
+			removed.ReadySCs[sc] = sci
+		}
+	}
+	builder.Build(removed)
+	picker = builder.Build(info)
+	if picked := pickInflight(t, picker, 5); len(picked["127.0.0.1:8000"]) != 5 {
+		t.Fatalf("picked %d of 5 for the readded peer", len(picked["127.0.0.1:8000"]))
+	}
+}
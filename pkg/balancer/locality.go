@@ -0,0 +1,163 @@
+package balancer
+
+import (
+	"math/rand"
+
+	grpcbalancer "google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+const (
+	// LocalityRoundRobin - the name of the locality aware weighted round robin balancer
+	LocalityRoundRobin = "locality_round_robin"
+	// LocalityThreshold - default min percent of the healthy local capacity before spilling over
+	LocalityThreshold = 70
+)
+
+func init() {
+	grpcbalancer.Register(newBuilder(LocalityRoundRobin, func(state *connState) base.V2PickerBuilder {
+		return &localityPickerBuilder{state: state}
+	}))
+}
+
+// Locality defines where the client or endpoint is
+type Locality struct {
+	Region string `json:"region,omitempty"`
+	Zone   string `json:"zone,omitempty"`
+}
+
+// locality returns the locality of the endpoint
+func (ep Endpoint) locality() Locality {
+	return Locality{Region: ep.Region, Zone: ep.Zone}
+}
+
+// the distances from the client to the endpoints
+const (
+	sameZone = iota
+	sameRegion
+	otherRegion
+	localityDistances
+)
+
+// distance returns how far the endpoint is from the client, the client without zone or region
+// only matches the endpoints by the other one
+func (l Locality) distance(ep Locality) int {
+	switch {
+	case l.Region != "" && l.Region != ep.Region:
+		return otherRegion
+	case l.Zone != "" && l.Zone == ep.Zone:
+		return sameZone
+	case l.Region != "":
+		return sameRegion
+	default:
+		return otherRegion
+	}
+}
+
+// the key of the client locality policy in resolver state attributes
+type localityPolicyKey struct{}
+
+// the locality of the client, and the min percent of the healthy local capacity
+type localityPolicy struct {
+	locality  Locality
+	threshold int
+}
+
+// distance returns how far the endpoint of the address is from the client, all the endpoints
+// are in other regions if the locality of the client is unknown
+func (p *localityPolicy) distance(addr resolver.Address) int {
+	if p == nil {
+		return otherRegion
+	}
+	ep, _ := AddressEndpoint(addr)
+	return p.locality.distance(ep.locality())
+}
+
+// stateLocality returns the client locality policy and the total weight of the endpoints by
+// the distance from the resolver state
+func stateLocality(state resolver.State) (*localityPolicy, [localityDistances]int) {
+	var weights [localityDistances]int
+	if state.Attributes == nil {
+		return nil, weights
+	}
+	policy, ok := state.Attributes.Value(localityPolicyKey{}).(*localityPolicy)
+	if !ok {
+		return nil, weights
+	}
+
+	for _, addr := range state.Addresses {
+		weights[policy.distance(addr)] += addressWeight(addr)
+	}
+	return policy, weights
+}
+
+// locality aware picker builder implements interface 'V2PickerBuilder'
+type localityPickerBuilder struct {
+	state *connState // the state of the client connection
+}
+
+// Build returns a locality aware picker with the ready subconns
+func (b *localityPickerBuilder) Build(info base.PickerBuildInfo) grpcbalancer.V2Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPickerV2(grpcbalancer.ErrNoSubConnAvailable)
+	}
+
+	policy, _ := b.state.Locality()
+	picker := &localityPicker{state: b.state}
+	for i := range picker.peers {
+		picker.peers[i] = newWrrPicker(b.state)
+	}
+	for sc, sci := range info.ReadySCs {
+		picker.peers[policy.distance(sci.Address)].add(sc, sci.Address)
+	}
+	return picker
+}
+
+// locality aware picker implements interface 'V2Picker', it picks the endpoints in the same
+// zone as the client, then the ones in the same region, and the ones in other regions. The
+// calls are spilled over to the farther endpoints when the healthy capacity of the nearer
+// ones is below the threshold, the calls are kept with the probability of the healthy percent
+// divided by the threshold, e.g. 29% (1 - 50/70) of the calls are spilled over when the
+// threshold is 70% and only 50% of the capacity in the same zone is healthy
+type localityPicker struct {
+	state *connState                    // the state of the client connection
+	peers [localityDistances]*wrrPicker // the ready peers by the distance
+}
+
+// Pick the peer by the healthy capacity of the nearer endpoints
+func (p *localityPicker) Pick(info grpcbalancer.PickInfo) (grpcbalancer.PickResult, error) {
+	policy, weights := p.state.Locality()
+
+	chosen := -1
+	for i, peers := range p.peers {
+		if peers.empty() {
+			continue
+		}
+		chosen = i
+		if policy == nil || weights[i] == 0 {
+			break
+		}
+
+		// the percent of the healthy capacity
+		healthy := peers.weight() * 100 / weights[i]
+		if healthy >= policy.threshold || rand.Intn(policy.threshold) < healthy {
+			break
+		}
+	}
+
+	result, err := p.peers[chosen].Pick(info)
+	if err != grpcbalancer.ErrNoSubConnAvailable {
+		return result, err
+	}
+	// the other distances may have the ready peers of the split versions
+	for i, peers := range p.peers {
+		if i == chosen || peers.empty() {
+			continue
+		}
+		if result, err = peers.Pick(info); err != grpcbalancer.ErrNoSubConnAvailable {
+			return result, err
+		}
+	}
+	return result, err
+}
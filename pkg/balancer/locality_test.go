@@ -0,0 +1,114 @@
+package balancer
+
+import (
+	"context"
+	"testing"
+
+	grpcbalancer "google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/resolver"
+)
+
+func TestLocalityDistance(t *testing.T) {
+	tests := []struct {
+		name     string
+		client   Locality
+		endpoint Locality
+		distance int
+	}{
+		{"same zone", Locality{"us-east", "a"}, Locality{"us-east", "a"}, sameZone},
+		{"same region", Locality{"us-east", "a"}, Locality{"us-east", "b"}, sameRegion},
+		{"other region", Locality{"us-east", "a"}, Locality{"us-west", "a"}, otherRegion},
+		{"client without zone", Locality{"us-east", ""}, Locality{"us-east", "a"}, sameRegion},
+		{"client without region", Locality{"", "a"}, Locality{"us-east", "a"}, sameZone},
+		{"endpoint without locality", Locality{"us-east", "a"}, Locality{}, otherRegion},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if distance := tt.client.distance(tt.endpoint); distance != tt.distance {
+				t.Fatalf("distance = %d, want %d", distance, tt.distance)
+			}
+		})
+	}
+}
+
+func TestLocalityPick(t *testing.T) {
+	eps := []Endpoint{
+		{IP: "127.0.0.1", Port: "8000", Region: "us-east", Zone: "a"},
+		{IP: "127.0.0.1", Port: "8001", Region: "us-east", Zone: "b"},
+		{IP: "127.0.0.1", Port: "8002", Region: "us-west", Zone: "a"},
+	}
+
+	tests := []struct {
+		name   string
+		client Locality
+		ready  []Endpoint     // the ready endpoints
+		zone   []Endpoint     // the other endpoints in the same zone, which aren't ready
+		picked map[string]int // the min percent of the calls to the endpoints
+	}{
+		{
+			name:   "same zone",
+			client: Locality{"us-east", "a"},
+			ready:  eps,
+			picked: map[string]int{"8000": 100},
+		},
+		{
+			name:   "same region for the client without zone",
+			client: Locality{"us-east", ""},
+			ready:  eps,
+			picked: map[string]int{"8000": 40, "8001": 40},
+		},
+		{
+			name:   "same region when the zone is down",
+			client: Locality{"us-east", "a"},
+			ready:  eps[1:],
+			picked: map[string]int{"8001": 100},
+		},
+		{
+			name:   "spill over part of the calls when the zone is partially healthy",
+			client: Locality{"us-east", "a"},
+			ready:  eps,
+			zone:   []Endpoint{{IP: "127.0.0.1", Port: "8003", Region: "us-east", Zone: "a"}},
+			// 50% of the zone is healthy, 1 - 50/70 of the calls are spilled over
+			picked: map[string]int{"8000": 68, "8001": 26},
+		},
+		{
+			name:   "other region when the region is down",
+			client: Locality{"us-east", "a"},
+			ready:  eps[2:],
+			picked: map[string]int{"8002": 100},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var addrs []resolver.Address
+			for _, ep := range append(eps, tt.zone...) {
+				addrs = append(addrs, newAddress("id-"+ep.Port, ep))
+			}
+			state := &connState{}
+			policy := &localityPolicy{locality: tt.client, threshold: LocalityThreshold}
+			state.locality = policy
+			for _, addr := range addrs {
+				state.weights[policy.distance(addr)] += addressWeight(addr)
+			}
+
+			picker := (&localityPickerBuilder{state: state}).Build(readySubConns(tt.ready...))
+			const calls = 10000
+			picked := make(map[string]int)
+			for i := 0; i < calls; i++ {
+				result, err := picker.Pick(grpcbalancer.PickInfo{Ctx: context.Background()})
+				if err != nil {
+					t.Fatal(err)
+				}
+				addr := result.SubConn.(*testSubConn).addr
+				picked[addr[len(addr)-4:]]++
+			}
+			for port, percent := range tt.picked {
+				if picked[port]*100 < percent*calls {
+					t.Fatalf("picked %v, want at least %v percent", picked, tt.picked)
+				}
+			}
+		})
+	}
+}
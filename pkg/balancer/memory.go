@@ -0,0 +1,367 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrRegistryClosed - the registry is closed
+	ErrRegistryClosed = errors.New("registry is closed")
+)
+
+// memory lease implements interface 'Lease', which keeps the key alive until stopped or expired
+type memoryLease struct {
+	registry *MemoryRegistry // the registry which the lease belongs to
+	id       int64           // the lease id
+	key      string          // the key bound to the lease
+	ttl      time.Duration   // the ttl of the lease
+	timer    *time.Timer     // expire the key when the lease is not renewed in time
+	stop     chan struct{}   // stop keeping the lease alive
+
+	mu      sync.RWMutex
+	renewed time.Time // the time when the lease was renewed last time
+}
+
+// memory item stored in the registry
+type memoryItem struct {
+	value []byte       // the value of the key
+	lease *memoryLease // the lease which the key is bound to, nil for the permanent key
+}
+
+// memory watcher delivers the events of the prefix in order
+type memoryWatcher struct {
+	prefix  string        // the watched prefix
+	mu      sync.Mutex    // protect the pending events
+	pending [][]*Event    // the events waiting for delivering
+	notify  chan struct{} // notify there are pending events
+	out     chan []*Event // the channel returned to the caller
+}
+
+// MemoryRegistry implements interface 'Registry' in process, the keys are bound to
+// the ttl leases and the changes are delivered to the prefix watchers, with the
+// same semantics as the etcd registry. It's mainly used for testing without etcd.
+type MemoryRegistry struct {
+	mu       sync.Mutex
+	items    map[string]*memoryItem      // the key and items
+	leases   map[*memoryLease]struct{}   // the leases alive, which may have no key after it's registered again
+	watchers map[*memoryWatcher]struct{} // the active watchers
+	closed   bool                        // the registry is closed
+	done     chan struct{}               // notify the watchers to exit
+	leaseID  int64                       // the id of the last granted lease
+	revision int64                       // the revision increased by each change, from 1 since 0 means no revision
+}
+
+// NewMemoryRegistry returns a registry in memory
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{
+		items:    make(map[string]*memoryItem),
+		leases:   make(map[*memoryLease]struct{}),
+		watchers: make(map[*memoryWatcher]struct{}),
+		done:     make(chan struct{}),
+		revision: 1,
+	}
+}
+
+// Register puts the key with a new lease, and keeps the lease alive until it's revoked or lost
+func (s *MemoryRegistry) Register(ctx context.Context, key string, value string, ttl int64) (Lease, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		return nil, errors.New("ttl should be positive")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrRegistryClosed
+	}
+
+	s.leaseID++
+	lease := &memoryLease{
+		registry: s,
+		id:       s.leaseID,
+		key:      key,
+		ttl:      time.Second * time.Duration(ttl),
+		stop:     make(chan struct{}),
+		renewed:  time.Now(),
+	}
+	// the key is deleted if the lease isn't renewed within ttl
+	lease.timer = time.AfterFunc(lease.ttl, func() {
+		s.expire(key, lease)
+	})
+	s.leases[lease] = struct{}{}
+	go s.keepalive(lease)
+
+	s.put(key, []byte(value), lease)
+	return lease, nil
+}
+
+// Deregister deletes the key and stops its lease
+func (s *MemoryRegistry) Deregister(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrRegistryClosed
+	}
+	s.delete(key)
+	return nil
+}
+
+// Expire the lease of the key immediately, as if the owner stopped keeping it alive
+// for longer than the ttl, the lease is lost. It returns false if the key doesn't exist.
+func (s *MemoryRegistry) Expire(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.delete(key)
+}
+
+// List returns the key and values with the prefix sorted by key, and the current revision
+func (s *MemoryRegistry) List(ctx context.Context, prefix string) ([]*KeyValue, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, 0, ErrRegistryClosed
+	}
+
+	var kvs []*KeyValue
+	for key, item := range s.items {
+		if strings.HasPrefix(key, prefix) {
+			kvs = append(kvs, &KeyValue{Key: key, Value: item.value})
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs, s.revision, nil
+}
+
+// Watch the changes of the keys with the prefix after the revision, the history isn't kept,
+// so the resync event is delivered if there're changes after the revision
+func (s *MemoryRegistry) Watch(ctx context.Context, prefix string, rev int64) <-chan []*Event {
+	w := &memoryWatcher{
+		prefix: prefix,
+		notify: make(chan struct{}, 1),
+		out:    make(chan []*Event),
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		close(w.out)
+		return w.out
+	}
+	if rev > 0 && rev < s.revision {
+		s.mu.Unlock()
+		go func() {
+			defer close(w.out)
+			select {
+			case w.out <- []*Event{{Type: EventResync}}:
+			case <-ctx.Done():
+			case <-s.done:
+			}
+		}()
+		return w.out
+	}
+	s.watchers[w] = struct{}{}
+	s.mu.Unlock()
+
+	go func() {
+		defer close(w.out)
+		defer func() {
+			s.mu.Lock()
+			delete(s.watchers, w)
+			s.mu.Unlock()
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.done:
+				return
+			case <-w.notify:
+			}
+
+			for {
+				w.mu.Lock()
+				if len(w.pending) == 0 {
+					w.mu.Unlock()
+					break
+				}
+				events := w.pending[0]
+				w.pending = w.pending[1:]
+				w.mu.Unlock()
+
+				select {
+				case w.out <- events:
+				case <-ctx.Done():
+					return
+				case <-s.done:
+					return
+				}
+			}
+		}
+	}()
+
+	return w.out
+}
+
+// Close the registry, all the keys are dropped without events and the watchers are closed
+func (s *MemoryRegistry) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+
+	for lease := range s.leases {
+		lease.close()
+	}
+	for key := range s.items {
+		delete(s.items, key)
+	}
+	return nil
+}
+
+// keep the lease alive like etcd, renew the lease at one third of the ttl
+func (s *MemoryRegistry) keepalive(lease *memoryLease) {
+	ticker := time.NewTicker(lease.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lease.stop:
+			return
+		case <-ticker.C:
+			lease.timer.Reset(lease.ttl)
+
+			lease.mu.Lock()
+			lease.renewed = time.Now()
+			lease.mu.Unlock()
+		}
+	}
+}
+
+// expire the key when the lease isn't renewed in time
+func (s *MemoryRegistry) expire(key string, lease *memoryLease) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the key may be registered again with another lease
+	if item, ok := s.items[key]; ok && item.lease == lease {
+		s.delete(key)
+	}
+	lease.close()
+}
+
+// put the key and notify the watchers, it should be called with the lock held
+func (s *MemoryRegistry) put(key string, value []byte, lease *memoryLease) {
+	// replace the previous item of the key, its lease is kept alive without the key like etcd
+	s.items[key] = &memoryItem{value: value, lease: lease}
+	s.revision++
+
+	s.broadcast(&Event{Type: EventPut, Kv: &KeyValue{Key: key, Value: value}})
+}
+
+// delete the key and notify the watchers, it should be called with the lock held
+func (s *MemoryRegistry) delete(key string) bool {
+	item, ok := s.items[key]
+	if !ok {
+		return false
+	}
+	if item.lease != nil {
+		item.lease.close()
+	}
+	delete(s.items, key)
+	s.revision++
+
+	s.broadcast(&Event{Type: EventDelete, Kv: &KeyValue{Key: key, Value: item.value}})
+	return true
+}
+
+// broadcast the event to the watchers, it should be called with the lock held
+func (s *MemoryRegistry) broadcast(event *Event) {
+	for w := range s.watchers {
+		if !strings.HasPrefix(event.Kv.Key, w.prefix) {
+			continue
+		}
+
+		w.mu.Lock()
+		w.pending = append(w.pending, []*Event{event})
+		w.mu.Unlock()
+
+		select {
+		case w.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// State returns the current state of the lease
+func (l *memoryLease) State() LeaseState {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	remaining := l.ttl - time.Since(l.renewed)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return LeaseState{
+		ID:          l.id,
+		TTL:         remaining,
+		LastRenewal: l.renewed,
+	}
+}
+
+// Done returns a channel which is closed when the lease is lost
+func (l *memoryLease) Done() <-chan struct{} {
+	return l.stop
+}
+
+// Revoke the lease, the key bound to the lease is deleted
+func (l *memoryLease) Revoke(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s := l.registry
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the key may be registered again with another lease
+	if item, ok := s.items[l.key]; ok && item.lease == l {
+		s.delete(l.key)
+	}
+	l.close()
+	return nil
+}
+
+// stop keeping the lease alive, it should be called with the registry lock held
+func (l *memoryLease) close() {
+	select {
+	case <-l.stop:
+	default:
+		l.timer.Stop()
+		close(l.stop)
+		delete(l.registry.leases, l)
+	}
+}
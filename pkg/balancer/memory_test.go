@@ -0,0 +1,193 @@
+package balancer
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryRegistryLease(t *testing.T) {
+	const key = "/services/my-service/a"
+
+	tests := []struct {
+		name   string
+		action func(t *testing.T, registry *MemoryRegistry, lease Lease)
+		exists bool      // the key exists after the action
+		lost   bool      // the lease is lost after the action
+		event  EventType // the event of the key after the put event
+	}{
+		{
+			name: "keepalive renews the lease",
+			action: func(t *testing.T, registry *MemoryRegistry, lease Lease) {
+				time.Sleep(time.Millisecond * 1500)
+			},
+			exists: true,
+			event:  -1,
+		},
+		{
+			name: "expire deletes the key",
+			action: func(t *testing.T, registry *MemoryRegistry, lease Lease) {
+				if !registry.Expire(key) {
+					t.Fatalf("key isn't expired")
+				}
+				if registry.Expire(key) {
+					t.Fatalf("key is expired twice")
+				}
+			},
+			lost:  true,
+			event: EventDelete,
+		},
+		{
+			name: "revoke deletes the key",
+			action: func(t *testing.T, registry *MemoryRegistry, lease Lease) {
+				if err := lease.Revoke(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			},
+			lost:  true,
+			event: EventDelete,
+		},
+		{
+			name: "deregister deletes the key",
+			action: func(t *testing.T, registry *MemoryRegistry, lease Lease) {
+				if err := registry.Deregister(context.Background(), key); err != nil {
+					t.Fatal(err)
+				}
+			},
+			lost:  true,
+			event: EventDelete,
+		},
+		{
+			name: "register again keeps the previous lease alive",
+			action: func(t *testing.T, registry *MemoryRegistry, lease Lease) {
+				if _, err := registry.Register(context.Background(), key, "b", 1); err != nil {
+					t.Fatal(err)
+				}
+			},
+			exists: true,
+			event:  EventPut,
+		},
+		{
+			name: "revoke the previous lease keeps the key registered again",
+			action: func(t *testing.T, registry *MemoryRegistry, lease Lease) {
+				if _, err := registry.Register(context.Background(), key, "b", 1); err != nil {
+					t.Fatal(err)
+				}
+				if err := lease.Revoke(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			},
+			exists: true,
+			lost:   true,
+			event:  EventPut,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := NewMemoryRegistry()
+			defer registry.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			eventChan := registry.Watch(ctx, "/services/", 0)
+
+			lease, err := registry.Register(context.Background(), key, "a", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if events := <-eventChan; events[0].Type != EventPut || events[0].Kv.Key != key {
+				t.Fatalf("unexpected event %+v", events[0])
+			}
+
+			tt.action(t, registry, lease)
+
+			kvs, _, err := registry.List(context.Background(), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exists := len(kvs) > 0; exists != tt.exists {
+				t.Fatalf("key exists = %v, want %v", exists, tt.exists)
+			}
+
+			select {
+			case <-lease.Done():
+				if !tt.lost {
+					t.Fatalf("lease is lost")
+				}
+			default:
+				if tt.lost {
+					t.Fatalf("lease isn't lost")
+				}
+			}
+
+			select {
+			case events := <-eventChan:
+				if events[0].Type != tt.event {
+					t.Fatalf("event type = %v, want %v", events[0].Type, tt.event)
+				}
+			case <-time.After(time.Millisecond * 100):
+				if tt.event >= 0 {
+					t.Fatalf("no event of the key")
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryRegistryWatchRevision(t *testing.T) {
+	tests := []struct {
+		name  string
+		stale bool      // watch from the revision before the change
+		rev   bool      // watch from the listed revision, or from now
+		event EventType // the first event of the watch
+	}{
+		{name: "watch from the latest revision", rev: true, event: EventPut},
+		{name: "watch from now", event: EventPut},
+		{name: "watch from the stale revision", stale: true, rev: true, event: EventResync},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := NewMemoryRegistry()
+			defer registry.Close()
+
+			_, rev, err := registry.List(context.Background(), "/services/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rev == 0 {
+				t.Fatalf("revision of the empty registry is 0")
+			}
+			if !tt.rev {
+				rev = 0
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			register := func() {
+				if _, err := registry.Register(context.Background(), "/services/my-service/a", "a", 1); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// the changes after the stale revision are lost
+			if tt.stale {
+				register()
+			}
+			eventChan := registry.Watch(ctx, "/services/", rev)
+			if !tt.stale {
+				register()
+			}
+
+			if events := <-eventChan; events[0].Type != tt.event {
+				t.Fatalf("event type = %v, want %v", events[0].Type, tt.event)
+			}
+			if tt.event == EventResync {
+				if _, ok := <-eventChan; ok {
+					t.Fatalf("watch isn't closed after resync")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package balancer
+
+import (
+	"context"
+	"sync"
+)
+
+// multi registry implements interface 'Registry' by combining several registries, the
+// services are discovered from all of them and registered into the first one
+type multiRegistry struct {
+	registries []Registry // the combined registries
+
+	mu        sync.Mutex
+	revisions map[string][]int64 // the revisions of the registries by the last listed prefix
+}
+
+// NewMultiRegistry returns a registry combining the registries, e.g. the services
+// registered in etcd and the legacy services only in dns
+func NewMultiRegistry(registries ...Registry) Registry {
+	return &multiRegistry{registries: registries, revisions: make(map[string][]int64)}
+}
+
+// Register puts the key and value into the first registry
+func (s *multiRegistry) Register(ctx context.Context, key string, value string, ttl int64) (Lease, error) {
+	if len(s.registries) == 0 {
+		return nil, ErrReadOnlyRegistry
+	}
+	return s.registries[0].Register(ctx, key, value, ttl)
+}
+
+// Deregister deletes the key from the first registry
+func (s *multiRegistry) Deregister(ctx context.Context, key string) error {
+	if len(s.registries) == 0 {
+		return ErrReadOnlyRegistry
+	}
+	return s.registries[0].Deregister(ctx, key)
+}
+
+// List returns the key and values with the prefix from all the registries, the revision
+// is the one of the first registry, and the revisions of the others are kept for watching
+func (s *multiRegistry) List(ctx context.Context, prefix string) ([]*KeyValue, int64, error) {
+	var list []*KeyValue
+	revisions := make([]int64, len(s.registries))
+	for i, registry := range s.registries {
+		kvs, rev, err := registry.List(ctx, prefix)
+		if err != nil {
+			return nil, 0, err
+		}
+		revisions[i] = rev
+		list = append(list, kvs...)
+	}
+	if len(revisions) == 0 {
+		return list, 0, nil
+	}
+
+	s.mu.Lock()
+	s.revisions[prefix] = revisions
+	s.mu.Unlock()
+	return list, revisions[0], nil
+}
+
+// Watch the changes of the keys with the prefix from all the registries, the others are
+// watched from their revisions of the last listing if the revision of the first registry
+// is the listed one, otherwise they're watched from now
+func (s *multiRegistry) Watch(ctx context.Context, prefix string, rev int64) <-chan []*Event {
+	eventChan := make(chan []*Event)
+
+	s.mu.Lock()
+	revisions := s.revisions[prefix]
+	s.mu.Unlock()
+	if len(revisions) != len(s.registries) || revisions[0] != rev {
+		revisions = make([]int64, len(s.registries))
+		if len(revisions) > 0 {
+			revisions[0] = rev
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i, registry := range s.registries {
+		rev := revisions[i]
+		wg.Add(1)
+		go func(watchChan <-chan []*Event) {
+			defer wg.Done()
+
+			for events := range watchChan {
+				select {
+				case eventChan <- events:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(registry.Watch(ctx, prefix, rev))
+	}
+
+	// close the channel after all the watches are closed
+	go func() {
+		wg.Wait()
+		close(eventChan)
+	}()
+
+	return eventChan
+}
+
+// Close all the registries
+func (s *multiRegistry) Close() error {
+	var err error
+	for _, registry := range s.registries {
+		if e := registry.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package balancer
+
+import (
+	"strings"
+	"time"
+)
+
+// Option configures the balancer, registrar, resolver and registries
+type Option func(*options)
+
+// options for the balancer, registrar, resolver and registries
+type options struct {
+	ttl            int64         // the register ttl seconds for service
+	interval       time.Duration // the interval time for checking if service is deleted
+	dialTimeout    time.Duration // the timeout for dialling the registry
+	requestTimeout time.Duration // the timeout for requesting the registry
+	namespace      string        // the key prefix of the services in registry
+	locality       *Locality     // the locality of the client, nil if unknown
+	threshold      int           // the min percent of the healthy local capacity before spilling over
+}
+
+// newOptions returns the options with the default values
+func newOptions(opts ...Option) *options {
+	o := &options{
+		ttl:            EtcdRegisterTTL,
+		interval:       time.Second * TimerCheckInterval,
+		dialTimeout:    time.Second * EtcdDialTimeout,
+		requestTimeout: time.Second * EtcdRequestTimeout,
+		namespace:      "/" + scheme,
+		threshold:      LocalityThreshold,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithTTL sets the register ttl for service, which is rounded up to seconds
+func WithTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		if ttl > 0 {
+			o.ttl = int64((ttl + time.Second - 1) / time.Second)
+		}
+	}
+}
+
+// WithInterval sets the interval time for checking if service is deleted, it's
+// also the max interval time for retrying to register service
+func WithInterval(interval time.Duration) Option {
+	return func(o *options) {
+		if interval > 0 {
+			o.interval = interval
+		}
+	}
+}
+
+// WithDialTimeout sets the timeout for dialling the registry
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		if timeout > 0 {
+			o.dialTimeout = timeout
+		}
+	}
+}
+
+// WithRequestTimeout sets the timeout for requesting the registry
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		if timeout > 0 {
+			o.requestTimeout = timeout
+		}
+	}
+}
+
+// WithNamespace sets the key prefix of the services in registry, e.g. '/prod/services',
+// so that several environments can share one etcd cluster. It's '/services' by default.
+func WithNamespace(namespace string) Option {
+	return func(o *options) {
+		if namespace = strings.Trim(namespace, "/"); namespace != "" {
+			o.namespace = "/" + namespace
+		}
+	}
+}
+
+// WithLocality sets the locality of the client, the locality aware balancer prefers the
+// endpoints in the same zone, then the ones in the same region, the zone may be empty
+func WithLocality(region, zone string) Option {
+	return func(o *options) {
+		if region != "" || zone != "" {
+			o.locality = &Locality{Region: region, Zone: zone}
+		}
+	}
+}
+
+// WithLocalityThreshold sets the min percent of the healthy local capacity, the calls are
+// spilled over to other zones, then other regions gradually when the healthy capacity of the
+// nearer endpoints is below it
+func WithLocalityThreshold(percent int) Option {
+	return func(o *options) {
+		if percent > 0 && percent <= 100 {
+			o.threshold = percent
+		}
+	}
+}
+
+// serviceKey returns the key of the service instance in registry
+func (o *options) serviceKey(service *Service) string {
+	return o.namespace + "/" + service.Name + "/" + service.ID
+}
@@ -0,0 +1,401 @@
+package balancer
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	grpcbalancer "google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// OutlierInterval - default interval time for counting the error rate
+	OutlierInterval = 10
+	// OutlierBaseEjectionTime - default base time for ejecting the endpoint, which is increased
+	// with backoff when the endpoint is ejected again
+	OutlierBaseEjectionTime = 30
+	// OutlierConsecutiveErrors - default number of the consecutive errors for ejecting the endpoint
+	OutlierConsecutiveErrors = 5
+	// OutlierFailurePercentage - default error rate in percent for ejecting the endpoint
+	OutlierFailurePercentage = 50
+	// OutlierMinRequests - default min number of the requests in the interval for the error rate
+	OutlierMinRequests = 20
+	// OutlierMaxEjectionPercent - default max percent of the ejected endpoints, at least one
+	// endpoint can be ejected if there're more than one
+	OutlierMaxEjectionPercent = 10
+)
+
+// Duration defines the duration in service config, e.g. "30s"
+type Duration time.Duration
+
+// UnmarshalJSON parses the duration string
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// OutlierDetection defines the config of the outlier detection in service config, which is
+// enabled by default for the balancers in this package, the zero values are the defaults, e.g.
+//
+//	{"outlierDetection": {"consecutiveErrors": 3, "baseEjectionTime": "10s"}}
+type OutlierDetection struct {
+	Disabled           bool     `json:"disabled,omitempty"`
+	Interval           Duration `json:"interval,omitempty"`
+	BaseEjectionTime   Duration `json:"baseEjectionTime,omitempty"`
+	ConsecutiveErrors  int      `json:"consecutiveErrors,omitempty"`
+	FailurePercentage  int      `json:"failurePercentage,omitempty"`
+	MinRequests        int      `json:"minRequests,omitempty"`
+	MaxEjectionPercent int      `json:"maxEjectionPercent,omitempty"`
+}
+
+// withDefaults returns the config with the default values
+func (c *OutlierDetection) withDefaults() OutlierDetection {
+	o := OutlierDetection{}
+	if c != nil {
+		o = *c
+	}
+	if o.Interval <= 0 {
+		o.Interval = Duration(time.Second * OutlierInterval)
+	}
+	if o.BaseEjectionTime <= 0 {
+		o.BaseEjectionTime = Duration(time.Second * OutlierBaseEjectionTime)
+	}
+	if o.ConsecutiveErrors <= 0 {
+		o.ConsecutiveErrors = OutlierConsecutiveErrors
+	}
+	if o.FailurePercentage <= 0 {
+		o.FailurePercentage = OutlierFailurePercentage
+	}
+	if o.MinRequests <= 0 {
+		o.MinRequests = OutlierMinRequests
+	}
+	if o.MaxEjectionPercent <= 0 {
+		o.MaxEjectionPercent = OutlierMaxEjectionPercent
+	}
+	return o
+}
+
+// isFailure returns true if the error means the endpoint is unhealthy
+func isFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown:
+		return true
+	}
+	return false
+}
+
+// the results of the requests to an endpoint
+type outlierStats struct {
+	consecutive int         // the number of the consecutive failures
+	failures    int         // the number of the failures in the interval
+	successes   int         // the number of the successes in the interval
+	since       time.Time   // the start time of the interval
+	ejections   int         // the number of the ejections in a row
+	ejected     *time.Timer // readmit the endpoint, nil if it's not ejected
+}
+
+// the outlier detector wraps the client connection and the picker builder of the base balancer,
+// the pickers are built without the ejected subconns, and rebuilt when any subconn is ejected
+// or readmitted
+type outlierDetector struct {
+	grpcbalancer.ClientConn                      // the client connection
+	builder                 base.V2PickerBuilder // the picker builder of the balancer
+	state                   *connState           // the state of the client connection
+
+	mu           sync.Mutex
+	info         base.PickerBuildInfo                   // the last ready subconns
+	connectivity connectivity.State                     // the last connectivity state
+	updated      bool                                   // the state is updated by the base balancer
+	stats        map[grpcbalancer.SubConn]*outlierStats // the results of the subconns
+	addrs        map[grpcbalancer.SubConn]string        // the addresses of the subconns
+	breakers     map[*endpointBreaker]struct{}          // the endpoint breakers of the picks
+	closed       bool                                   // the balancer is closed
+}
+
+// newOutlierDetector returns an outlier detector for the client connection and the picker builder
+func newOutlierDetector(cc grpcbalancer.ClientConn, builder base.V2PickerBuilder, state *connState) *outlierDetector {
+	return &outlierDetector{
+		ClientConn: cc,
+		builder:    builder,
+		state:      state,
+		stats:      make(map[grpcbalancer.SubConn]*outlierStats),
+		addrs:      make(map[grpcbalancer.SubConn]string),
+		breakers:   make(map[*endpointBreaker]struct{}),
+	}
+}
+
+// NewSubConn is called by the base balancer, the address of the subconn is kept
+func (d *outlierDetector) NewSubConn(addrs []resolver.Address, opts grpcbalancer.NewSubConnOptions) (grpcbalancer.SubConn, error) {
+	sc, err := d.ClientConn.NewSubConn(addrs, opts)
+	if err != nil || len(addrs) == 0 {
+		return sc, err
+	}
+
+	d.mu.Lock()
+	d.addrs[sc] = addrs[0].Addr
+	d.mu.Unlock()
+	return sc, nil
+}
+
+// Build returns a picker with the ready subconns which aren't ejected
+func (d *outlierDetector) Build(info base.PickerBuildInfo) grpcbalancer.V2Picker {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.info = info
+	for sc := range info.ReadySCs {
+		if d.stats[sc] == nil {
+			d.stats[sc] = &outlierStats{since: time.Now()}
+		}
+	}
+	return d.build()
+}
+
+// build the picker without the ejected subconns, all the ready subconns are used if
+// all of them are ejected
+func (d *outlierDetector) build() grpcbalancer.V2Picker {
+	info := base.PickerBuildInfo{ReadySCs: make(map[grpcbalancer.SubConn]base.SubConnInfo)}
+	for sc, sci := range d.info.ReadySCs {
+		if s := d.stats[sc]; s == nil || s.ejected == nil {
+			info.ReadySCs[sc] = sci
+		}
+	}
+	if len(info.ReadySCs) == 0 {
+		info = d.info
+	}
+
+	addrs := make(map[grpcbalancer.SubConn]string, len(info.ReadySCs))
+	for sc, sci := range info.ReadySCs {
+		addrs[sc] = sci.Address.Addr
+	}
+	return &outlierPicker{V2Picker: d.builder.Build(info), detector: d, addrs: addrs}
+}
+
+// UpdateState is called by the base balancer, the picker is rebuilt with the latest ejections
+func (d *outlierDetector) UpdateState(state grpcbalancer.State) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.connectivity, d.updated = state.ConnectivityState, true
+	if state.ConnectivityState != connectivity.TransientFailure {
+		state.Picker = d.build()
+	}
+	d.ClientConn.UpdateState(state)
+}
+
+// RemoveSubConn is called by the base balancer, the results of the subconn are dropped, and
+// the circuits of the endpoint are forgotten if it isn't resolved any more
+func (d *outlierDetector) RemoveSubConn(sc grpcbalancer.SubConn) {
+	d.mu.Lock()
+	if s := d.stats[sc]; s != nil && s.ejected != nil {
+		s.ejected.Stop()
+	}
+	delete(d.stats, sc)
+
+	addr, ok := d.addrs[sc]
+	delete(d.addrs, sc)
+	for _, other := range d.addrs {
+		if other == addr {
+			ok = false
+			break
+		}
+	}
+	if ok {
+		for e := range d.breakers {
+			e.breaker.forget(e.service, addr)
+		}
+	}
+	d.mu.Unlock()
+
+	d.ClientConn.RemoveSubConn(sc)
+}
+
+// update the picker after the subconn is ejected or readmitted
+func (d *outlierDetector) update() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed || !d.updated || d.connectivity == connectivity.TransientFailure {
+		return
+	}
+	d.ClientConn.UpdateState(grpcbalancer.State{ConnectivityState: d.connectivity, Picker: d.build()})
+}
+
+// track the endpoint breaker of the pick, so that its circuits of the removed endpoints are
+// forgotten, the breakers of the same service are tracked once
+func (d *outlierDetector) track(breaker *endpointBreaker) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for e := range d.breakers {
+		if e.breaker == breaker.breaker && e.service == breaker.service {
+			return
+		}
+	}
+	d.breakers[breaker] = struct{}{}
+}
+
+// record the result of the request to the subconn, and eject it if it's an outlier
+func (d *outlierDetector) record(sc grpcbalancer.SubConn, err error) {
+	config := d.state.Config().OutlierDetection.withDefaults()
+	if config.Disabled {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s := d.stats[sc]
+	if s == nil || s.ejected != nil {
+		return
+	}
+
+	// start a new interval for the error rate
+	if time.Since(s.since) > time.Duration(config.Interval) {
+		s.failures, s.successes, s.since = 0, 0, time.Now()
+	}
+
+	if !isFailure(err) {
+		s.consecutive = 0
+		s.successes++
+		// the endpoint is recovered after the ejection
+		if s.successes >= config.MinRequests {
+			s.ejections = 0
+		}
+		return
+	}
+	s.consecutive++
+	s.failures++
+
+	total := s.failures + s.successes
+	if s.consecutive >= config.ConsecutiveErrors ||
+		(total >= config.MinRequests && s.failures*100 >= config.FailurePercentage*total) {
+		d.eject(sc, s, config)
+	}
+}
+
+// eject the subconn if the max ejection percent isn't exceeded, it's readmitted after
+// the ejection time, which is increased with backoff when it's ejected again
+func (d *outlierDetector) eject(sc grpcbalancer.SubConn, s *outlierStats, config OutlierDetection) {
+	ejected := 0
+	for sc := range d.info.ReadySCs {
+		if s := d.stats[sc]; s != nil && s.ejected != nil {
+			ejected++
+		}
+	}
+	total := len(d.info.ReadySCs)
+	if total <= 1 || (ejected > 0 && (ejected+1)*100 > config.MaxEjectionPercent*total) {
+		return
+	}
+
+	base := time.Duration(config.BaseEjectionTime)
+	duration := backoff(s.ejections, base, base*10)
+	s.ejections++
+	s.consecutive, s.failures, s.successes = 0, 0, 0
+	s.ejected = time.AfterFunc(duration, func() {
+		d.readmit(sc)
+	})
+	log.Printf("subconn {%s} is ejected for %v", d.info.ReadySCs[sc].Address.Addr, duration)
+
+	go d.update()
+}
+
+// readmit the ejected subconn
+func (d *outlierDetector) readmit(sc grpcbalancer.SubConn) {
+	d.mu.Lock()
+	s := d.stats[sc]
+	if s == nil || s.ejected == nil {
+		d.mu.Unlock()
+		return
+	}
+	s.ejected = nil
+	s.since = time.Now()
+	log.Printf("subconn {%s} is readmitted", d.info.ReadySCs[sc].Address.Addr)
+	d.mu.Unlock()
+
+	d.update()
+}
+
+// close the detector, the readmission timers are stopped
+func (d *outlierDetector) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.closed = true
+	for _, s := range d.stats {
+		if s.ejected != nil {
+			s.ejected.Stop()
+		}
+	}
+}
+
+// the picker records the results of the requests for the outlier detector, and skips the
+// endpoints whose circuits are open if the circuit breaker is enabled for each endpoint
+type outlierPicker struct {
+	grpcbalancer.V2Picker
+	detector *outlierDetector
+	addrs    map[grpcbalancer.SubConn]string // the addresses of the subconns
+}
+
+// Pick the subconn by the picker of the balancer, and record the result
+func (p *outlierPicker) Pick(info grpcbalancer.PickInfo) (grpcbalancer.PickResult, error) {
+	breaker := endpointBreakerFromContext(info.Ctx)
+	if breaker != nil {
+		p.detector.track(breaker)
+	}
+
+	// pick again if the circuit of the endpoint is open
+	for i := 0; i <= len(p.addrs); i++ {
+		result, err := p.V2Picker.Pick(info)
+		if err != nil {
+			return result, err
+		}
+		addr := p.addrs[result.SubConn]
+		if breaker == nil || breaker.allow(addr) {
+			return p.record(result, breaker, addr), nil
+		}
+		// release the skipped pick, the balancers don't take 'ErrCircuitOpen' as a result
+		if result.Done != nil {
+			result.Done(grpcbalancer.DoneInfo{Err: ErrCircuitOpen})
+		}
+	}
+
+	// the balancer keeps picking the endpoints with open circuits, e.g. the latency aware
+	// balancer prefers the peers without any result, pick any endpoint whose circuit is closed
+	for sc, addr := range p.addrs {
+		if breaker.allow(addr) {
+			return p.record(grpcbalancer.PickResult{SubConn: sc}, breaker, addr), nil
+		}
+	}
+	return grpcbalancer.PickResult{}, ErrCircuitOpen
+}
+
+// record returns the pick result which records the result of the request when it's done
+func (p *outlierPicker) record(result grpcbalancer.PickResult, breaker *endpointBreaker, addr string) grpcbalancer.PickResult {
+	start := time.Now()
+	done := result.Done
+	result.Done = func(info grpcbalancer.DoneInfo) {
+		p.detector.record(result.SubConn, info.Err)
+		if breaker != nil {
+			breaker.record(addr, info.Err, time.Since(start))
+		}
+		if done != nil {
+			done(info)
+		}
+	}
+	return result
+}
@@ -0,0 +1,206 @@
+package balancer
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	grpcbalancer "google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// outlierDetection returns the ready subconns of the endpoints, and the outlier detector of
+// the weighted round robin balancer with the config
+func outlierDetection(config OutlierDetection, endpoints int) (base.PickerBuildInfo, *outlierDetector) {
+	var eps []Endpoint
+	for i := 0; i < endpoints; i++ {
+		eps = append(eps, Endpoint{IP: "127.0.0.1", Port: strconv.Itoa(8000 + i)})
+	}
+	state := &connState{config: &Config{OutlierDetection: &config}}
+	return readySubConns(eps...), newOutlierDetector(nil, &wrrPickerBuilder{state: state}, state)
+}
+
+// finishPicks picks until the endpoint of the port is picked for each of the results, the
+// request to it fails if the result is true, and the requests to the others succeed
+func finishPicks(t *testing.T, picker grpcbalancer.V2Picker, port string, failed ...bool) {
+	t.Helper()
+
+	for i := 0; len(failed) > 0; i++ {
+		if i > 1000 {
+			t.Fatalf("endpoint %s isn't picked", port)
+		}
+		result, err := picker.Pick(grpcbalancer.PickInfo{Ctx: context.Background()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var info grpcbalancer.DoneInfo
+		if addr := result.SubConn.(*testSubConn).addr; addr[len(addr)-4:] == port {
+			if failed[0] {
+				info.Err = status.Error(codes.Unavailable, "unavailable")
+			}
+			failed = failed[1:]
+		}
+		result.Done(info)
+	}
+}
+
+// pickedPorts returns the ports of the endpoints picked by the picker
+func pickedPorts(t *testing.T, picker grpcbalancer.V2Picker) map[string]bool {
+	t.Helper()
+
+	picked := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		result, err := picker.Pick(grpcbalancer.PickInfo{Ctx: context.Background()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := result.SubConn.(*testSubConn).addr
+		picked[addr[len(addr)-4:]] = true
+	}
+	return picked
+}
+
+// waitReadmitted waits until the ejected endpoint of the port is readmitted
+func waitReadmitted(t *testing.T, info base.PickerBuildInfo, detector *outlierDetector, port string) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second * 2); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if pickedPorts(t, detector.Build(info))[port] {
+			return
+		}
+	}
+	t.Fatalf("endpoint %s isn't readmitted", port)
+}
+
+func TestOutlierEjection(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  OutlierDetection
+		failed  []bool // the results of the requests to the endpoint
+		ejected bool   // the endpoint is ejected after the requests
+	}{
+		{
+			name:    "consecutive errors",
+			config:  OutlierDetection{ConsecutiveErrors: 3},
+			failed:  []bool{true, true, true},
+			ejected: true,
+		},
+		{
+			name:   "errors interrupted by a success",
+			config: OutlierDetection{ConsecutiveErrors: 3},
+			failed: []bool{true, true, false, true, true},
+		},
+		{
+			name:    "failure percentage",
+			config:  OutlierDetection{ConsecutiveErrors: 100, FailurePercentage: 50, MinRequests: 10},
+			failed:  []bool{false, true, false, true, false, true, false, true, false, true},
+			ejected: true,
+		},
+		{
+			name:   "failure percentage below the min requests",
+			config: OutlierDetection{ConsecutiveErrors: 100, FailurePercentage: 50, MinRequests: 10},
+			failed: []bool{false, true, false, true, false, true, false, true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, detector := outlierDetection(tt.config, 10)
+			defer detector.close()
+
+			finishPicks(t, detector.Build(info), "8000", tt.failed...)
+			if picked := pickedPorts(t, detector.Build(info)); picked["8000"] == tt.ejected {
+				t.Fatalf("picked %v, want ejected = %v", picked, tt.ejected)
+			}
+		})
+	}
+}
+
+func TestOutlierMaxEjectionPercent(t *testing.T) {
+	info, detector := outlierDetection(OutlierDetection{ConsecutiveErrors: 1, MaxEjectionPercent: 10}, 10)
+	defer detector.close()
+
+	// only one of the 10 endpoints can be ejected
+	finishPicks(t, detector.Build(info), "8000", true)
+	finishPicks(t, detector.Build(info), "8001", true)
+	if picked := pickedPorts(t, detector.Build(info)); picked["8000"] || !picked["8001"] {
+		t.Fatalf("picked %v, want only 8000 ejected", picked)
+	}
+}
+
+func TestOutlierAllEjected(t *testing.T) {
+	info, detector := outlierDetection(OutlierDetection{ConsecutiveErrors: 1, MaxEjectionPercent: 100}, 2)
+	defer detector.close()
+
+	finishPicks(t, detector.Build(info), "8000", true)
+	finishPicks(t, detector.Build(info), "8001", true)
+
+	// all the endpoints are used when all of them are ejected
+	if picked := pickedPorts(t, detector.Build(info)); !picked["8000"] || !picked["8001"] {
+		t.Fatalf("picked %v, want all the endpoints", picked)
+	}
+}
+
+func TestOutlierReadmission(t *testing.T) {
+	base := time.Millisecond * 50
+	info, detector := outlierDetection(OutlierDetection{ConsecutiveErrors: 1, BaseEjectionTime: Duration(base)}, 10)
+	defer detector.close()
+
+	// the endpoint is readmitted after the base ejection time
+	start := time.Now()
+	finishPicks(t, detector.Build(info), "8000", true)
+	waitReadmitted(t, info, detector, "8000")
+	if elapsed := time.Since(start); elapsed < base*8/10 {
+		t.Fatalf("endpoint is readmitted after %v, want %v", elapsed, base)
+	}
+
+	// the ejection time is doubled when it's ejected again
+	start = time.Now()
+	finishPicks(t, detector.Build(info), "8000", true)
+	waitReadmitted(t, info, detector, "8000")
+	if elapsed := time.Since(start); elapsed < base*2*8/10 {
+		t.Fatalf("endpoint is readmitted again after %v, want %v", elapsed, base*2)
+	}
+}
+
+func TestOutlierPickOpenCircuit(t *testing.T) {
+	eps := []Endpoint{
+		{IP: "127.0.0.1", Port: "8000"},
+		{IP: "127.0.0.1", Port: "8001"},
+	}
+	builder := &ewmaPickerBuilder{stats: make(map[grpcbalancer.SubConn]*ewmaStats)}
+	detector := newOutlierDetector(nil, builder, &connState{})
+	picker := detector.Build(readySubConns(eps...))
+
+	// open the circuit of the first endpoint
+	breaker := NewCircuitBreaker(BreakerConfig{PerEndpoint: true})
+	ctx, e, err := breaker.start(context.Background(), "my-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	openCircuit(breaker.circuit("my-service@127.0.0.1:8000"), e.config)
+
+	for i := 0; i < 20; i++ {
+		result, err := picker.Pick(grpcbalancer.PickInfo{Ctx: ctx})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr := result.SubConn.(*testSubConn).addr; addr != "127.0.0.1:8001" {
+			t.Fatalf("picked %s with the open circuit", addr)
+		}
+		result.Done(grpcbalancer.DoneInfo{})
+	}
+
+	// the skipped picks are released without any sample
+	for sc, s := range builder.stats {
+		if sc.(*testSubConn).addr != "127.0.0.1:8000" {
+			continue
+		}
+		if s.inflight != 0 || !s.updated.IsZero() {
+			t.Fatalf("skipped peer has %d in-flight requests, updated at %v", s.inflight, s.updated)
+		}
+	}
+}
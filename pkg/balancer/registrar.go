@@ -0,0 +1,391 @@
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrAlreadyRegistered - the service with the same name and id is already registered
+	ErrAlreadyRegistered = errors.New("service is already registered")
+	// ErrNotRegistered - the service isn't registered by the registrar
+	ErrNotRegistered = errors.New("service is not registered")
+)
+
+// Registrar registers the services into registry, and keeps them alive with the leases.
+// It tracks many registrations concurrently, each with its own key and lease.
+type Registrar struct {
+	registry Registry // the registry backend
+	opts     *options // the options for registering
+
+	mu            sync.Mutex
+	registrations map[string]*Registration // the key and registrations, nil for registering
+}
+
+// NewRegistrar returns a registrar based on the registry backend
+func NewRegistrar(registry Registry, opts ...Option) *Registrar {
+	return &Registrar{
+		registry:      registry,
+		opts:          newOptions(opts...),
+		registrations: make(map[string]*Registration),
+	}
+}
+
+// Registration defines a service registered by the registrar, it owns one lease at a time
+type Registration struct {
+	registrar *Registrar         // the registrar which tracks the registration
+	registry  Registry           // the registry backend
+	opts      *options           // the options for registering
+	service   *Service           // the registered service
+	key       string             // the key of the service in registry
+	body      string             // the json string of the service
+	ctx       context.Context    // the context of the keepalive loop
+	cancel    context.CancelFunc // stop the keepalive loop
+	exit      chan struct{}      // the keepalive loop is exited
+	once      sync.Once          // close the registration once
+	health    chan bool          // the serving status, nil if it isn't gated by health
+
+	mu    sync.Mutex
+	lease Lease // the current lease which the key is bound to, nil if not registered
+}
+
+// Register the service into registry, it retries with backoff until the service is registered,
+// or returns the error when the context is done. After registered, the service is kept alive in
+// the background and registered again when the lease is lost, until the registration is closed.
+// It returns ErrAlreadyRegistered if the service with the same name and id is registered.
+func (s *Registrar) Register(ctx context.Context, service *Service) (*Registration, error) {
+	r, err := s.newRegistration(service)
+	if err != nil {
+		return nil, err
+	}
+
+	// register once before starting the keepalive loop
+	lease, err := r.register(ctx)
+	if err != nil {
+		r.cancel()
+		s.remove(r.key, nil)
+		return nil, err
+	}
+	r.lease = lease
+
+	s.mu.Lock()
+	s.registrations[r.key] = r
+	s.mu.Unlock()
+
+	go r.run()
+
+	return r, nil
+}
+
+// new a registration for the service, and reserve the key until the registration is removed
+func (s *Registrar) newRegistration(service *Service) (*Registration, error) {
+	if service == nil || service.Name == "" || service.ID == "" {
+		return nil, errors.New("service name and id should not be empty")
+	}
+	if err := checkServiceKey(service); err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(service)
+	if err != nil {
+		return nil, err
+	}
+
+	// reserve the key before registering
+	key := s.opts.serviceKey(service)
+	s.mu.Lock()
+	if _, ok := s.registrations[key]; ok {
+		s.mu.Unlock()
+		return nil, ErrAlreadyRegistered
+	}
+	s.registrations[key] = nil
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Registration{
+		registrar: s,
+		registry:  s.registry,
+		opts:      s.opts,
+		service:   service,
+		key:       key,
+		body:      string(body),
+		ctx:       ctx,
+		cancel:    cancel,
+		exit:      make(chan struct{}),
+	}, nil
+}
+
+// checkServiceKey checks the service name and id are valid in the key. The name is split by '/'
+// into the hierarchical segments, e.g. 'team/payments/ledger', the id is a single segment, and
+// the segments can't be empty, '*' or start with '_' which is reserved for the policies.
+func checkServiceKey(service *Service) error {
+	if strings.Contains(service.ID, "/") {
+		return fmt.Errorf("invalid service id {%s}", service.ID)
+	}
+	for _, segment := range append(strings.Split(service.Name, "/"), service.ID) {
+		if segment == "" || segment == "*" || strings.HasPrefix(segment, "_") {
+			return fmt.Errorf("invalid service name {%s} or id {%s}", service.Name, service.ID)
+		}
+	}
+	return nil
+}
+
+// Registrations returns the registered services
+func (s *Registrar) Registrations() []*Registration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []*Registration
+	for _, r := range s.registrations {
+		if r != nil {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+// Deregister the service, which is registered by the registrar
+func (s *Registrar) Deregister(ctx context.Context, service *Service) error {
+	s.mu.Lock()
+	r := s.registrations[s.opts.serviceKey(service)]
+	s.mu.Unlock()
+
+	if r == nil {
+		return ErrNotRegistered
+	}
+	return r.Close(ctx)
+}
+
+// DeregisterAll deregisters all the services registered by the registrar concurrently,
+// and returns the first error
+func (s *Registrar) DeregisterAll(ctx context.Context) error {
+	registrations := s.Registrations()
+
+	errs := make(chan error, len(registrations))
+	for _, r := range registrations {
+		go func(r *Registration) {
+			errs <- r.Close(ctx)
+		}(r)
+	}
+
+	var err error
+	for range registrations {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// remove the registration of the key, if it's the same registration
+func (s *Registrar) remove(key string, r *Registration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current, ok := s.registrations[key]; ok && current == r {
+		delete(s.registrations, key)
+	}
+}
+
+// Service returns the registered service
+func (r *Registration) Service() *Service {
+	return r.service
+}
+
+// Key returns the key of the service in registry
+func (r *Registration) Key() string {
+	return r.key
+}
+
+// Lease returns the current lease which the service is bound to, or nil if the service
+// isn't in registry, e.g. it's not serving for the health gated registration
+func (r *Registration) Lease() Lease {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.lease
+}
+
+// Close stops keeping the service alive and revokes the lease, the service is deleted
+// from registry. It returns the error if the lease can't be revoked before the context
+// is done, then the lease is revoked in the background or deleted after expired.
+func (r *Registration) Close(ctx context.Context) error {
+	err := errors.New("registration is closed")
+	r.once.Do(func() {
+		r.registrar.remove(r.key, r)
+
+		// wait for the keepalive loop, so that there isn't any new lease
+		r.cancel()
+		select {
+		case <-r.exit:
+		case <-ctx.Done():
+			err = ctx.Err()
+			// revoke the lease in the background after the loop is exited
+			go func() {
+				<-r.exit
+				ctx, cancel := context.WithTimeout(context.Background(), r.opts.requestTimeout)
+				defer cancel()
+				r.revoke(ctx)
+			}()
+			return
+		}
+
+		err = r.revoke(ctx)
+	})
+	return err
+}
+
+// revoke the current lease, the service is deleted from registry
+func (r *Registration) revoke(ctx context.Context) error {
+	r.mu.Lock()
+	lease := r.lease
+	r.lease = nil
+	r.mu.Unlock()
+
+	if lease == nil {
+		return nil
+	}
+	if err := lease.Revoke(ctx); err != nil {
+		return err
+	}
+	log.Printf("service {%s} is deregistered", r.key)
+
+	return nil
+}
+
+// register the service with a new lease, and retry with backoff until succeeded or the context is done
+func (r *Registration) register(ctx context.Context) (Lease, error) {
+	for retries := 0; ; retries++ {
+		lease, err := r.tryRegister(ctx)
+		if err == nil {
+			return lease, nil
+		}
+		if err == ErrReadOnlyRegistry || err == ErrRegistryClosed {
+			return nil, err
+		}
+		log.Printf("register service {%s}: %v", r.key, err)
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("register service {%s}: %v, last error: %v", r.key, ctx.Err(), err)
+		case <-time.After(backoff(retries, time.Second*RegisterRetryInterval, r.opts.interval)):
+		}
+	}
+}
+
+// try to register the service once, the request is limited by the timeout
+func (r *Registration) tryRegister(ctx context.Context) (Lease, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.opts.requestTimeout)
+	defer cancel()
+
+	return r.registry.Register(ctx, r.key, r.body, r.opts.ttl)
+}
+
+// check if the service is still in registry, in case it's deleted with the lease alive
+func (r *Registration) check() (bool, error) {
+	ctx, cancel := context.WithTimeout(r.ctx, r.opts.requestTimeout)
+	defer cancel()
+
+	kvs, _, err := r.registry.List(ctx, r.key)
+	if err != nil {
+		return false, err
+	}
+	for _, kv := range kvs {
+		if kv.Key == r.key {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// renew registers the service again with a new lease, returns false if the registration is closed
+func (r *Registration) renew() bool {
+	lease, err := r.register(r.ctx)
+	if err != nil {
+		if r.ctx.Err() == nil {
+			log.Printf("register service {%s}: %v", r.key, err)
+		}
+		return false
+	}
+
+	r.mu.Lock()
+	r.lease = lease
+	r.mu.Unlock()
+
+	log.Printf("service {%s} is registered again with lease {%x}", r.key, lease.State().ID)
+	return true
+}
+
+// keep the service alive until the registration is closed
+func (r *Registration) run() {
+	defer close(r.exit)
+
+	// start a timer for checking if the service is deleted
+	ticker := time.NewTimer(r.opts.interval)
+	defer ticker.Stop()
+
+	for {
+		// the lease is nil when the service isn't serving
+		lease := r.Lease()
+		var leaseDone <-chan struct{}
+		if lease != nil {
+			leaseDone = lease.Done()
+		}
+
+		select {
+		case <-r.ctx.Done():
+			return
+
+		case serving := <-r.health:
+			if serving && lease == nil {
+				// the service is serving, register it
+				log.Printf("service {%s} is serving, register it", r.key)
+				if !r.renew() {
+					return
+				}
+			} else if !serving && lease != nil {
+				// the service isn't serving, delete it from registry until it's recovered
+				log.Printf("service {%s} is not serving, deregister it", r.key)
+				if err := r.revoke(r.ctx); err != nil {
+					log.Printf("revoke lease {%x}: %v", lease.State().ID, err)
+				}
+			}
+
+		case <-leaseDone:
+			if r.ctx.Err() != nil {
+				return
+			}
+			// the lease is lost, register the service again with a new lease
+			log.Printf("lease of service {%s} is lost, register again", r.key)
+			if !r.renew() {
+				return
+			}
+
+		case <-ticker.C:
+			if lease == nil {
+				ticker.Reset(r.opts.interval)
+				continue
+			}
+			ok, err := r.check()
+			if err != nil {
+				log.Printf("check service {%s}: %v", r.key, err)
+			} else if !ok {
+				// the service is deleted while the lease is alive, revoke the lease and register again
+				log.Printf("service {%s} is deleted, register again", r.key)
+				if err := lease.Revoke(r.ctx); err != nil {
+					log.Printf("revoke lease {%x}: %v", lease.State().ID, err)
+				}
+				if !r.renew() {
+					return
+				}
+			}
+			ticker.Reset(r.opts.interval)
+		}
+	}
+}
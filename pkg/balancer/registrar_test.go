@@ -0,0 +1,157 @@
+package balancer
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// waitKey waits until the key exists or not in the registry
+func waitKey(t *testing.T, registry Registry, key string, exists bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second * 2); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+		kvs, _, err := registry.List(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(kvs) > 0) == exists {
+			return
+		}
+	}
+	t.Fatalf("key {%s} exists != %v", key, exists)
+}
+
+func TestRegistrarRegisterAgain(t *testing.T) {
+	tests := []struct {
+		name string
+		lose func(registry *MemoryRegistry, r *Registration) // lose the registered key
+	}{
+		{
+			name: "lease is lost",
+			lose: func(registry *MemoryRegistry, r *Registration) {
+				registry.Expire(r.Key())
+			},
+		},
+		{
+			name: "lease is revoked",
+			lose: func(registry *MemoryRegistry, r *Registration) {
+				r.Lease().Revoke(context.Background())
+			},
+		},
+		{
+			name: "key is deleted with the lease alive",
+			lose: func(registry *MemoryRegistry, r *Registration) {
+				registry.Deregister(context.Background(), r.Key())
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := NewMemoryRegistry()
+			defer registry.Close()
+
+			registrar := NewRegistrar(registry, WithInterval(time.Millisecond*50))
+			service := &Service{ID: "a", Name: "my-service", Endpoints: []Endpoint{{IP: "127.0.0.1", Port: "8000"}}}
+			r, err := registrar.Register(context.Background(), service)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lease := r.Lease()
+
+			tt.lose(registry, r)
+			waitKey(t, registry, r.Key(), true)
+			for deadline := time.Now().Add(time.Second); r.Lease() == lease; time.Sleep(time.Millisecond * 10) {
+				if time.Now().After(deadline) {
+					t.Fatalf("service isn't registered with a new lease")
+				}
+			}
+			select {
+			case <-r.Lease().Done():
+				t.Fatalf("new lease is lost")
+			default:
+			}
+
+			if err := r.Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			waitKey(t, registry, r.Key(), false)
+		})
+	}
+}
+
+func TestRegistrarServiceKey(t *testing.T) {
+	registry := NewMemoryRegistry()
+	defer registry.Close()
+	registrar := NewRegistrar(registry)
+
+	tests := []struct {
+		service *Service
+		valid   bool
+	}{
+		{service: &Service{ID: "a", Name: "my-service"}, valid: true},
+		{service: &Service{ID: "a", Name: "team/payments/ledger"}, valid: true},
+		{service: &Service{ID: "", Name: "my-service"}},
+		{service: &Service{ID: "a/b", Name: "my-service"}},
+		{service: &Service{ID: "_a", Name: "my-service"}},
+		{service: &Service{ID: "a", Name: "team//ledger"}},
+		{service: &Service{ID: "a", Name: "team/*"}},
+		{service: &Service{ID: "a", Name: "team/_config"}},
+	}
+
+	for _, tt := range tests {
+		_, err := registrar.Register(context.Background(), tt.service)
+		if (err == nil) != tt.valid {
+			t.Fatalf("register service %+v: %v, want valid = %v", tt.service, err, tt.valid)
+		}
+	}
+}
+
+func TestRegistrarMultiple(t *testing.T) {
+	registry := NewMemoryRegistry()
+	defer registry.Close()
+
+	registrar := NewRegistrar(registry)
+	services := []*Service{
+		{ID: "a", Name: "my-service", Endpoints: []Endpoint{{IP: "127.0.0.1", Port: "8000"}}},
+		{ID: "b", Name: "my-service", Endpoints: []Endpoint{{IP: "127.0.0.1", Port: "8001"}}},
+		{ID: "a", Name: "other-service", Endpoints: []Endpoint{{IP: "127.0.0.1", Port: "9000"}}},
+	}
+	for _, service := range services {
+		if _, err := registrar.Register(context.Background(), service); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := registrar.Register(context.Background(), services[0]); err != ErrAlreadyRegistered {
+		t.Fatalf("register twice: %v", err)
+	}
+	if n := len(registrar.Registrations()); n != len(services) {
+		t.Fatalf("got %d registrations, want %d", n, len(services))
+	}
+
+	// the service is deregistered individually, and can be registered again
+	if err := registrar.Deregister(context.Background(), services[1]); err != nil {
+		t.Fatal(err)
+	}
+	waitKey(t, registry, "/services/my-service/b", false)
+	waitKey(t, registry, "/services/my-service/a", true)
+	waitKey(t, registry, "/services/other-service/a", true)
+	if err := registrar.Deregister(context.Background(), services[1]); err != ErrNotRegistered {
+		t.Fatalf("deregister twice: %v", err)
+	}
+	if _, err := registrar.Register(context.Background(), services[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	// all the services are deregistered
+	if err := registrar.DeregisterAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"/services/my-service/a", "/services/my-service/b", "/services/other-service/a"} {
+		waitKey(t, registry, key, false)
+	}
+	if n := len(registrar.Registrations()); n != 0 {
+		t.Fatalf("got %d registrations after deregistering all", n)
+	}
+}
@@ -0,0 +1,120 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// EventType defines the type of the registry event
+type EventType int
+
+const (
+	// EventPut - the key is created or updated
+	EventPut EventType = iota
+	// EventDelete - the key is deleted or expired
+	EventDelete
+	// EventResync - some changes are lost, e.g. the revision is compacted, the watcher should
+	// list the keys again and watch from the new revision, the channel is closed after it
+	EventResync
+)
+
+// KeyValue defines the key and value stored in registry
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+// Event defines the change of a key in registry
+type Event struct {
+	Type EventType
+	// for the put event, it's the current key and value,
+	// for the delete event, it's the previous key and value,
+	// for the resync event, it's nil
+	Kv *KeyValue
+}
+
+// LeaseState defines the state of a lease
+type LeaseState struct {
+	ID          int64         // the lease id
+	TTL         time.Duration // the remaining ttl of the lease
+	LastRenewal time.Time     // the time when the lease was renewed last time
+}
+
+// Lease defines the lease which the registered key is bound to
+type Lease interface {
+	// State returns the current state of the lease
+	State() LeaseState
+	// Done returns a channel which is closed when the lease is lost, e.g. it's expired,
+	// revoked or the keepalive is halted
+	Done() <-chan struct{}
+	// Revoke the lease, the key bound to the lease is deleted
+	Revoke(ctx context.Context) error
+}
+
+// the context key of listing or watching the subtree of the services
+type subtreeKey struct{}
+
+// WithSubtree returns the context for listing or watching all the services under the prefix,
+// e.g. '/services/team/' for the services 'team/payments' and 'team/payments/ledger', instead
+// of the instances of a single service. The registries which can't list the subtree, e.g. the
+// dns registry, return nothing for it.
+func WithSubtree(ctx context.Context) context.Context {
+	return context.WithValue(ctx, subtreeKey{}, true)
+}
+
+// IsSubtree returns true if the context is for listing or watching the subtree of the services
+func IsSubtree(ctx context.Context) bool {
+	subtree, _ := ctx.Value(subtreeKey{}).(bool)
+	return subtree
+}
+
+// Registry defines the storage backend for registering and discovering services
+type Registry interface {
+	// Register puts the key and value into registry, the key is bound to a new lease
+	// with the ttl seconds, and the lease is kept alive until it's revoked or lost
+	Register(ctx context.Context, key string, value string, ttl int64) (Lease, error)
+	// Deregister deletes the key from registry
+	Deregister(ctx context.Context, key string) error
+	// List returns all the key and values with the prefix, and the revision of the registry
+	// when they're listed, the revision is 0 if the registry doesn't support it
+	List(ctx context.Context, prefix string) ([]*KeyValue, int64, error)
+	// Watch returns a channel which receives the events of the keys with the prefix after
+	// the revision, or from now if it's 0, the channel is closed when the context is done
+	Watch(ctx context.Context, prefix string, rev int64) <-chan []*Event
+	// Close the registry
+	Close() error
+}
+
+// NewRegistry returns a registry by the uri, which supports:
+//
+//	etcd://host1:2379,host2:2379 - the etcd registry with the endpoints
+//	file:///path/to/services     - the file registry with a directory or a single file
+//	dns://nameserver:53/?domain=example.com&port=15001
+//	                             - the dns registry with the optional nameserver, domain,
+//	                               and the default port for the A/AAAA records
+//
+// the uri without scheme is treated as the etcd address separated by ';'
+func NewRegistry(uri string, opts ...Option) (Registry, error) {
+	if !strings.Contains(uri, "://") {
+		return NewEtcdRegistry(uri, opts...)
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "etcd":
+		return NewEtcdRegistry(strings.Replace(u.Host, ",", ";", -1), opts...)
+	case "file":
+		return NewFileRegistry(u.Path, opts...)
+	case "dns":
+		query := u.Query()
+		return NewDNSRegistry(u.Host, query.Get("domain"), query.Get("port"), opts...), nil
+	default:
+		return nil, fmt.Errorf("unsupported registry {%s}", uri)
+	}
+}
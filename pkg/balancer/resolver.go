@@ -5,35 +5,40 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/coreos/etcd/clientv3"
-	"github.com/coreos/etcd/mvcc/mvccpb"
+	"google.golang.org/grpc/attributes"
 	"google.golang.org/grpc/resolver"
 )
 
-// etcd resolver implements interfaces 'Builder and Resolver'
-type etcdResolver struct {
-	client *clientv3.Client // the etcd client
-
-	// resolver.ClientConn contains the callbacks for resolver to notify any updates to the gRPC ClientConn.
-	cc resolver.ClientConn
-
-	done chan struct{} // close the resolver
+// etcd resolver builder implements interface 'Builder', it creates a resolver for each target
+type etcdResolverBuilder struct {
+	registry Registry // the registry backend
+	opts     *options // the options of the resolvers
 }
 
-// newResolver returns a etcd resolver
-func newResolver(client *clientv3.Client) resolver.Builder {
-	return &etcdResolver{
-		client: client,
-		done:   make(chan struct{}),
+// newResolverBuilder returns a resolver builder based on the registry
+func newResolverBuilder(registry Registry, opts *options) resolver.Builder {
+	return &etcdResolverBuilder{
+		registry: registry,
+		opts:     opts,
 	}
 }
 
-// Build creates a new resolver for the given target.
-func (s *etcdResolver) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
-	// grpc client connection
-	s.cc = cc
+// Build creates a new resolver for the given target, which has its own watch and addresses,
+// so that many services can be dialled with the same builder.
+func (b *etcdResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	s := &etcdResolver{
+		registry:   b.registry,
+		opts:       b.opts,
+		cc:         cc,
+		resolveNow: make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
 
 	// start a goroutine for watching the service path
 	if err := s.watch(target); err != nil {
@@ -44,19 +49,60 @@ func (s *etcdResolver) Build(target resolver.Target, cc resolver.ClientConn, opt
 }
 
 // Scheme returns the scheme supported by this resolver.
-func (s *etcdResolver) Scheme() string {
+func (b *etcdResolverBuilder) Scheme() string {
 	return scheme
 }
 
-// ResolveNow will be called by gRPC to try to resolve the target name again.
+// etcd resolver implements interface 'Resolver' for a target
+type etcdResolver struct {
+	registry Registry // the registry backend
+	opts     *options // the options of the resolver
+
+	// resolver.ClientConn contains the callbacks for resolver to notify any updates to the gRPC ClientConn.
+	cc resolver.ClientConn
+
+	prefix   string   // the key prefix of the service, which ends with '/'
+	subtree  bool     // the nested services under the prefix are included
+	selector selector // the selector of the endpoints
+
+	resolveNow chan struct{} // notify to list the service again
+	listed     time.Time     // the time of the last listing
+	done       chan struct{} // close the resolver
+	once       sync.Once     // close the resolver once
+}
+
+// ResolveNow will be called by gRPC to try to resolve the target name again, e.g. when the
+// subconns are failed. The service is listed again at most once in 'ResolveNowInterval'.
 func (s *etcdResolver) ResolveNow(opts resolver.ResolveNowOptions) {
+	select {
+	case s.resolveNow <- struct{}{}:
+	default:
+	}
 }
 
 // Close the resolver.
 func (s *etcdResolver) Close() {
-	if s.done != nil {
+	s.once.Do(func() {
 		close(s.done)
+	})
+}
+
+// newState returns the resolver state with the addresses, the policies of the service, and the
+// locality policy of the client
+func (s *etcdResolver) newState(addrs []resolver.Address, policy *servicePolicy) resolver.State {
+	var kvs []interface{}
+	if len(policy.split) > 0 {
+		kvs = append(kvs, splitKey{}, policy.split)
+	}
+	if s.opts.locality != nil {
+		kvs = append(kvs, localityPolicyKey{}, &localityPolicy{locality: *s.opts.locality, threshold: s.opts.threshold})
+	}
+
+	state := resolver.State{Addresses: addrs, ServiceConfig: policy.config}
+	if len(kvs) > 0 {
+		state.Attributes = attributes.New(kvs...)
 	}
+	return state
 }
 
 func struct2JSON(v interface{}) string {
@@ -64,151 +110,301 @@ func struct2JSON(v interface{}) string {
 	return string(b)
 }
 
-// watch and handle the address changes for service from etcd registry
+// watch and handle the address changes for service from registry
 func (s *etcdResolver) watch(target resolver.Target) error {
-	prefix := "/" + target.Scheme + "/" + target.Endpoint
-	// get the root directory of the service
-	root, err := s.client.Get(context.Background(), prefix, clientv3.WithPrefix())
+	// the endpoints of the service are filtered by the selector, e.g. 'my-service?version=v1.0.0'
+	name, selector, err := parseTarget(target.Endpoint)
 	if err != nil {
-		log.Printf("client Get {%s}: %v", prefix, err)
+		log.Printf("parse target {%s}: %v", target.Endpoint, err)
 		return err
 	}
+	s.prefix, s.subtree = servicePrefix(s.opts.namespace, name)
+	s.selector = selector
+
+	// get the root directory of the service, the error is reported to grpc if the registry is
+	// unreachable, and the service is listed again in the background
+	index, policy, rev, err := s.list()
+	if err != nil {
+		s.cc.UpdateState(resolver.State{})
+		s.cc.ReportError(fmt.Errorf("registry List {%s}: %v", s.prefix, err))
+	} else {
+		// trigger the grpc client connection to update the addresses
+		s.cc.UpdateState(s.newState(index.addresses(), policy))
+	}
+
+	go s.run(index, policy, rev)
+
+	return nil
+}
+
+// list the keys of the service, and returns the address index, the policies and the revision
+func (s *etcdResolver) list() (addressIndex, *servicePolicy, int64, error) {
+	ctx, cancel := context.WithTimeout(s.context(), s.opts.requestTimeout)
+	defer cancel()
+
+	s.listed = time.Now()
+	kvs, rev, err := s.registry.List(ctx, s.prefix)
+	if err != nil {
+		log.Printf("registry List {%s}: %v", s.prefix, err)
+		return nil, nil, 0, err
+	}
+
+	index := make(addressIndex)
+	policy := &servicePolicy{}
+	// init the address from registry for the service
+	for _, kv := range kvs {
+		// the policies of the service, e.g. the traffic split policy and service config
+		if s.isPolicyKey(kv.Key) {
+			s.updatePolicy(policy, kv.Key, kv.Value)
+			continue
+		}
+		if !s.isInstanceKey(kv.Key) {
+			continue
+		}
+		index.put(kv.Key, s.instanceAddresses(kv.Value))
+	}
+	return index, policy, rev, nil
+}
+
+// servicePrefix returns the key prefix of the service name, and whether the nested services
+// are included. The name is hierarchical, e.g. 'team/payments/ledger', and the subtree of the
+// services is dialled by '/*', e.g. 'team/payments/*' for all the services of the team.
+func servicePrefix(namespace string, name string) (string, bool) {
+	subtree := false
+	if name == "*" || strings.HasSuffix(name, "/*") {
+		subtree = true
+		name = strings.TrimSuffix(name, "*")
+	}
+	if name = strings.Trim(name, "/"); name == "" {
+		return namespace + "/", subtree
+	}
+	return namespace + "/" + name + "/", subtree
+}
+
+// context returns the context for listing and watching the service, or the subtree of the services
+func (s *etcdResolver) context() context.Context {
+	if s.subtree {
+		return WithSubtree(context.Background())
+	}
+	return context.Background()
+}
+
+// isPolicyKey returns true if the key is a reserved key of the dialled service, the reserved
+// keys of the nested services are ignored
+func (s *etcdResolver) isPolicyKey(key string) bool {
+	rest := strings.TrimPrefix(key, s.prefix)
+	return strings.HasPrefix(rest, "_") && !strings.Contains(rest, "/")
+}
+
+// isInstanceKey returns true if the key is an instance of the dialled service, or of the
+// nested services if the subtree is dialled
+func (s *etcdResolver) isInstanceKey(key string) bool {
+	rest := strings.TrimPrefix(key, s.prefix)
+	return !isReservedKey(key) && (s.subtree || !strings.Contains(rest, "/"))
+}
+
+// instanceAddresses returns the addresses of the endpoints filtered by the selector, from
+// the value of the instance key
+func (s *etcdResolver) instanceAddresses(value []byte) []resolver.Address {
+	var service Service
+	// unmarshal the json string to service
+	if err := json.Unmarshal(value, &service); err != nil {
+		log.Printf("unmarshal {%q}: %v", value, err)
+		return nil
+	}
 
 	var addrs []resolver.Address
-	// init the address from etcd registry for the service
-	for _, item := range root.Kvs {
-		key := string(item.Key)
-		res, err := s.client.Get(context.Background(), key)
-		if err != nil {
-			log.Printf("client Get {%s}: %v", key, err)
-			return err
+	for _, endpoint := range s.selector.filter(service.Endpoints) {
+		addrs = append(addrs, newAddress(service.ID, endpoint))
+	}
+	return addrs
+}
+
+// run watches the changes after the revision until the resolver is closed. When the changes
+// are lost, e.g. the revision is compacted, or grpc asks to resolve again, the keys are listed
+// again and the addresses are replaced, so that they're always consistent with the registry.
+// The error is reported to grpc if the registry is unreachable.
+func (s *etcdResolver) run(index addressIndex, policy *servicePolicy, rev int64) {
+	for {
+		// the index is nil if the first listing is failed
+		if index != nil {
+			s.handle(index, policy, rev)
 		}
-		for _, node := range res.Kvs {
-			var service Service
-			if err := json.Unmarshal(node.Value, &service); err != nil {
-				log.Printf("unmarshal {%q}: %v", node.Value, err)
-				return err
+
+		// list again until it's successful or the resolver is closed
+		for retries := 0; ; retries++ {
+			select {
+			case <-s.done:
+				return
+			default:
 			}
-			for _, endpoint := range service.Endpoints {
-				addrs = append(addrs, resolver.Address{
-					Addr: fmt.Sprintf("%s:%s", endpoint.IP, endpoint.Port),
-				})
+
+			listed, newPolicy, newRev, err := s.list()
+			if err == nil {
+				if index == nil {
+					index = make(addressIndex)
+				}
+				index.resync(listed)
+				policy, rev = newPolicy, newRev
+				s.cc.UpdateState(s.newState(index.addresses(), policy))
+				break
+			}
+			s.cc.ReportError(fmt.Errorf("registry List {%s}: %v", s.prefix, err))
+
+			select {
+			case <-s.done:
+				return
+			case <-time.After(backoff(retries, time.Second, time.Second*EtcdWatchRetryInterval)):
 			}
 		}
 	}
+}
 
-	// trigger the grpc client connection to update the addresses
-	s.cc.NewAddress(addrs)
+// handle the watch events after the revision, it returns when the resolver is closed, the
+// changes are lost or grpc asks to resolve again. The request to resolve again is postponed
+// until 'ResolveNowInterval' after the last listing.
+func (s *etcdResolver) handle(index addressIndex, policy *servicePolicy, rev int64) {
+	ctx, cancel := context.WithCancel(s.context())
+	defer cancel()
 
-	go func() {
-		// watch and handle the changes for the service from etcd registry
-		watchChan := s.client.Watch(context.Background(), prefix, clientv3.WithPrefix(), clientv3.WithPrevKV())
+	// watch and handle the changes for the service from registry
+	eventChan := s.registry.Watch(ctx, s.prefix, rev)
 
-		for {
-			select {
-			case <-s.done:
+	// the postponed request to resolve again
+	var postponed <-chan time.Time
+
+	for {
+		select {
+		case <-s.done:
+			return
+
+		case <-s.resolveNow:
+			// the watch is restarted from the revision of the listing
+			wait := time.Second*ResolveNowInterval - time.Since(s.listed)
+			if wait <= 0 {
 				return
+			}
+			if postponed == nil {
+				postponed = time.After(wait)
+			}
 
-			case data := <-watchChan:
-				if data.Err() != nil {
-					log.Printf("watch error: %v", data.Err())
-					time.Sleep(time.Second * 5)
-					continue
+		case <-postponed:
+			return
+
+		case events, ok := <-eventChan:
+			if !ok {
+				log.Printf("watch {%s} is closed", s.prefix)
+				return
+			}
+
+			// handle the watch events
+			updated := false
+			for _, event := range events {
+				if event.Type == EventResync {
+					return
 				}
 
-				// handle the watch events
-				for _, event := range data.Events {
-					switch event.Type {
-					case mvccpb.PUT:
-						// for the addition event, the kv should not be empty
-						if event.Kv == nil {
-							log.Printf("current kv is nil for addition")
-							continue
-						}
-
-						var service Service
-						// unmarshal the json string to service
-						if err := json.Unmarshal(event.Kv.Value, &service); err != nil {
-							log.Printf("unmarshal {%q}: %v", event.Kv.Value, err)
-							continue
-						}
-
-						var ok bool
-						// handle the endpoints
-						if addrs, ok = addition(addrs, service.Endpoints); ok {
-							s.cc.NewAddress(addrs)
-						}
-
-					case mvccpb.DELETE:
-						// for the delete event, the prev kv should not be empty
-						if event.PrevKv == nil {
-							log.Printf("previous kv is nil for deletion")
-							continue
-						}
-
-						var service Service
-						// unmarshal the json string to service
-						if err := json.Unmarshal(event.PrevKv.Value, &service); err != nil {
-							log.Printf("unmarshal {%q}: %v", event.PrevKv.Value, err)
-							continue
-						}
-
-						var ok bool
-						// handle the endpoints
-						if addrs, ok = deletion(addrs, service.Endpoints); ok {
-							s.cc.NewAddress(addrs)
-						}
+				// the policies of the service are changed
+				if s.isPolicyKey(event.Kv.Key) {
+					var value []byte
+					if event.Type == EventPut {
+						value = event.Kv.Value
 					}
+					if s.updatePolicy(policy, event.Kv.Key, value) {
+						updated = true
+					}
+					continue
+				}
+				if !s.isInstanceKey(event.Kv.Key) {
+					continue
+				}
+
+				// the endpoints of the instance are replaced or removed
+				var addrs []resolver.Address
+				if event.Type == EventPut {
+					addrs = s.instanceAddresses(event.Kv.Value)
 				}
+				if index.put(event.Kv.Key, addrs) {
+					updated = true
+				}
+			}
+			if updated {
+				s.cc.UpdateState(s.newState(index.addresses(), policy))
 			}
 		}
-	}()
-
-	return nil
+	}
 }
 
-func matchAddress(eps []Endpoint, addr string) bool {
-	for _, ep := range eps {
-		epAddr := fmt.Sprintf("%s:%s", ep.IP, ep.Port)
-		if addr == epAddr {
-			return true
+// the addresses of the service instances indexed by the registry key
+type addressIndex map[string][]resolver.Address
+
+// put replaces the addresses of the instance, or removes the instance if there's no address,
+// the existing address is kept if its endpoint isn't changed, so that its subconn isn't
+// recreated. It returns true if the addresses are changed.
+func (idx addressIndex) put(key string, addrs []resolver.Address) bool {
+	current := idx[key]
+	if len(addrs) == 0 {
+		delete(idx, key)
+		return len(current) > 0
+	}
+
+	changed := len(addrs) != len(current)
+	for i, addr := range addrs {
+		if j := indexAddress(current, addr); j >= 0 {
+			addrs[i] = current[j]
+		}
+		if !changed && addrs[i].Attributes != current[i].Attributes {
+			changed = true
 		}
 	}
-	return false
+	idx[key] = addrs
+	return changed
 }
 
-func matchEndpoint(addrs []resolver.Address, ep Endpoint) bool {
-	for _, item := range addrs {
-		addr := fmt.Sprintf("%s:%s", ep.IP, ep.Port)
-		if item.Addr == addr {
-			return true
+// resync replaces the instances with the listed ones
+func (idx addressIndex) resync(listed addressIndex) {
+	for key := range idx {
+		if _, ok := listed[key]; !ok {
+			delete(idx, key)
 		}
 	}
-	return false
+	for key, addrs := range listed {
+		idx.put(key, addrs)
+	}
 }
 
-// try to add the address
-func addition(addrs []resolver.Address, eps []Endpoint) (newAddrs []resolver.Address, added bool) {
-	// copy the slice
-	newAddrs = addrs[:]
-	for _, ep := range eps {
-		if !matchEndpoint(addrs, ep) {
-			addr := fmt.Sprintf("%s:%s", ep.IP, ep.Port)
-			newAddrs = append(newAddrs, resolver.Address{Addr: addr})
-			added = true
+// addresses returns the addresses of all the instances in the order of the keys, the same
+// address of several instances is only kept for the first one
+func (idx addressIndex) addresses() []resolver.Address {
+	keys := make([]string, 0, len(idx))
+	for key := range idx {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var addrs []resolver.Address
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		for _, addr := range idx[key] {
+			if !seen[addr.Addr] {
+				seen[addr.Addr] = true
+				addrs = append(addrs, addr)
+			}
 		}
 	}
-	return
+	return addrs
 }
 
-// try to delete the address
-func deletion(addrs []resolver.Address, eps []Endpoint) (newAddrs []resolver.Address, deleted bool) {
-	for _, item := range addrs {
-		if matchAddress(eps, item.Addr) {
-			deleted = true
+// indexAddress returns the index of the address with the same endpoint and service id, or -1
+func indexAddress(addrs []resolver.Address, addr resolver.Address) int {
+	ep, _ := AddressEndpoint(addr)
+	for i, item := range addrs {
+		if item.Addr != addr.Addr || AddressServiceID(item) != AddressServiceID(addr) {
 			continue
 		}
-		newAddrs = append(newAddrs, item)
+		if current, _ := AddressEndpoint(item); reflect.DeepEqual(current, ep) {
+			return i
+		}
 	}
-	return
+	return -1
 }
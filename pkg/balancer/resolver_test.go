@@ -0,0 +1,448 @@
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// test client connection keeps the states and errors from the resolver
+type testClientConn struct {
+	mu     sync.Mutex
+	states []resolver.State
+	errs   []error
+}
+
+func (c *testClientConn) UpdateState(state resolver.State) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.states = append(c.states, state)
+}
+
+func (c *testClientConn) ReportError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errs = append(c.errs, err)
+}
+
+func (c *testClientConn) NewAddress(addrs []resolver.Address) {}
+
+func (c *testClientConn) NewServiceConfig(config string) {}
+
+func (c *testClientConn) ParseServiceConfig(config string) *serviceconfig.ParseResult {
+	return &serviceconfig.ParseResult{}
+}
+
+// state returns the last state from the resolver
+func (c *testClientConn) state() (resolver.State, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.states) == 0 {
+		return resolver.State{}, false
+	}
+	return c.states[len(c.states)-1], true
+}
+
+// waitAddrs waits until the sorted addresses of the last state are the expected ones
+func (c *testClientConn) waitAddrs(t *testing.T, want ...string) resolver.State {
+	t.Helper()
+	return c.waitIDs(t, want, nil)
+}
+
+// waitIDs waits until the sorted addresses of the last state are the expected ones, and the
+// addresses are owned by the expected services
+func (c *testClientConn) waitIDs(t *testing.T, want []string, ids map[string]string) resolver.State {
+	t.Helper()
+
+	var got []string
+	for deadline := time.Now().Add(time.Second * 3); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+		state, ok := c.state()
+		if !ok {
+			continue
+		}
+		got = got[:0]
+		owned := true
+		for _, addr := range state.Addresses {
+			got = append(got, addr.Addr)
+			if id, ok := ids[addr.Addr]; ok && AddressServiceID(addr) != id {
+				owned = false
+			}
+		}
+		sort.Strings(got)
+		if equalStrings(got, want) && owned {
+			return state
+		}
+	}
+	t.Fatalf("addresses = %v, want %v owned by %v", got, want, ids)
+	return resolver.State{}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// putService puts the service instance into the registry
+func putService(t *testing.T, registry Registry, name string, id string, eps ...Endpoint) {
+	t.Helper()
+
+	body, err := json.Marshal(&Service{ID: id, Name: name, Endpoints: eps})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.Register(context.Background(), "/"+scheme+"/"+name+"/"+id, string(body), 30); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// buildResolver builds a resolver of the target on the registry
+func buildResolver(t *testing.T, registry Registry, target string) (resolver.Resolver, *testClientConn) {
+	t.Helper()
+
+	cc := &testClientConn{}
+	r, err := newResolverBuilder(registry, newOptions()).Build(resolver.Target{Endpoint: target}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, cc
+}
+
+func TestResolverDialFirst(t *testing.T) {
+	registry := NewMemoryRegistry()
+	defer registry.Close()
+
+	r, cc := buildResolver(t, registry, "my-service")
+	defer r.Close()
+
+	// the instance is registered right after dialling
+	putService(t, registry, "my-service", "a", Endpoint{IP: "127.0.0.1", Port: "8000"})
+	cc.waitAddrs(t, "127.0.0.1:8000")
+}
+
+// resolver test changes the registry after the resolver is built, and waits for the addresses
+type resolverTest struct {
+	name   string
+	target string
+	action func(t *testing.T, registry *MemoryRegistry) // change the registry, nil for no change
+	want   []string                                     // the expected addresses
+	ids    map[string]string                            // the expected service id of the addresses
+}
+
+// testEndpoint returns the endpoint of the port and version, with the metadata of the key values
+func testEndpoint(port string, version string, kvs ...string) Endpoint {
+	ep := Endpoint{IP: "127.0.0.1", Port: port, Version: version}
+	if len(kvs) > 0 {
+		ep.Metadata = make(map[string]string)
+		for i := 0; i+1 < len(kvs); i += 2 {
+			ep.Metadata[kvs[i]] = kvs[i+1]
+		}
+	}
+	return ep
+}
+
+// runResolverTests runs the tests with the instance 'a' of 8000 in v1, and the instance 'b' of
+// 8001 and 8002 in v2, the canary 8002 has a different role
+func runResolverTests(t *testing.T, tests []resolverTest) {
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := NewMemoryRegistry()
+			defer registry.Close()
+
+			putService(t, registry, "my-service", "a", testEndpoint("8000", "v1", "role", "service"))
+			putService(t, registry, "my-service", "b", testEndpoint("8001", "v2", "role", "service"), testEndpoint("8002", "v2", "role", "canary"))
+
+			r, cc := buildResolver(t, registry, tt.target)
+			defer r.Close()
+			if _, ok := cc.state(); !ok {
+				t.Fatalf("no state after the resolver is built")
+			}
+
+			if tt.action != nil {
+				tt.action(t, registry)
+			}
+			cc.waitIDs(t, tt.want, tt.ids)
+		})
+	}
+}
+
+func TestResolverUpdates(t *testing.T) {
+	runResolverTests(t, []resolverTest{
+		{
+			name:   "put a new instance",
+			target: "my-service",
+			action: func(t *testing.T, registry *MemoryRegistry) {
+				putService(t, registry, "my-service", "c", testEndpoint("8002", "v1"))
+			},
+			want: []string{"127.0.0.1:8000", "127.0.0.1:8001", "127.0.0.1:8002"},
+		},
+		{
+			name:   "delete an instance",
+			target: "my-service",
+			action: func(t *testing.T, registry *MemoryRegistry) {
+				registry.Expire("/services/my-service/a")
+			},
+			want: []string{"127.0.0.1:8001", "127.0.0.1:8002"},
+		},
+	})
+}
+
+func TestResolverServiceName(t *testing.T) {
+	runResolverTests(t, []resolverTest{
+		{
+			name:   "match the service name exactly",
+			target: "my-service",
+			action: func(t *testing.T, registry *MemoryRegistry) {
+				putService(t, registry, "my-service-canary", "a", testEndpoint("9000", "v1"))
+				putService(t, registry, "my-service/nested", "a", testEndpoint("9001", "v1"))
+				// the last change is resolved after the others
+				putService(t, registry, "my-service", "c", testEndpoint("8003", "v1"))
+			},
+			want: []string{"127.0.0.1:8000", "127.0.0.1:8001", "127.0.0.1:8002", "127.0.0.1:8003"},
+		},
+		{
+			name:   "dial the subtree of the services",
+			target: "my-service/*",
+			action: func(t *testing.T, registry *MemoryRegistry) {
+				putService(t, registry, "my-service-canary", "a", testEndpoint("9000", "v1"))
+				putService(t, registry, "my-service/nested", "a", testEndpoint("9001", "v1"))
+				putService(t, registry, "my-service", "c", testEndpoint("8003", "v1"))
+			},
+			want: []string{"127.0.0.1:8000", "127.0.0.1:8001", "127.0.0.1:8002", "127.0.0.1:8003", "127.0.0.1:9001"},
+		},
+		{
+			name:   "dial a hierarchical service name",
+			target: "my-service/nested",
+			action: func(t *testing.T, registry *MemoryRegistry) {
+				putService(t, registry, "my-service/nested/deeper", "a", testEndpoint("9002", "v1"))
+				putService(t, registry, "my-service/nested", "a", testEndpoint("9001", "v1"))
+			},
+			want: []string{"127.0.0.1:9001"},
+		},
+	})
+}
+
+func TestResolverIndex(t *testing.T) {
+	runResolverTests(t, []resolverTest{
+		{
+			name:   "edit an instance with fewer endpoints",
+			target: "my-service",
+			action: func(t *testing.T, registry *MemoryRegistry) {
+				putService(t, registry, "my-service", "b", testEndpoint("8003", "v1"))
+			},
+			want: []string{"127.0.0.1:8000", "127.0.0.1:8003"},
+		},
+		{
+			name:   "delete one of the instances sharing an address",
+			target: "my-service",
+			action: func(t *testing.T, registry *MemoryRegistry) {
+				putService(t, registry, "my-service", "c", testEndpoint("8000", "v1"))
+				registry.Expire("/services/my-service/a")
+			},
+			want: []string{"127.0.0.1:8000", "127.0.0.1:8001", "127.0.0.1:8002"},
+			ids:  map[string]string{"127.0.0.1:8000": "c"},
+		},
+		{
+			name:   "move an endpoint to another instance",
+			target: "my-service",
+			action: func(t *testing.T, registry *MemoryRegistry) {
+				putService(t, registry, "my-service", "b", testEndpoint("8002", "v2"))
+				putService(t, registry, "my-service", "c", testEndpoint("8001", "v2"))
+			},
+			want: []string{"127.0.0.1:8000", "127.0.0.1:8001", "127.0.0.1:8002"},
+			ids:  map[string]string{"127.0.0.1:8001": "c", "127.0.0.1:8002": "b"},
+		},
+		{
+			name:   "duplicate endpoints of an instance",
+			target: "my-service",
+			action: func(t *testing.T, registry *MemoryRegistry) {
+				putService(t, registry, "my-service", "c", testEndpoint("8003", "v1"), testEndpoint("8003", "v1"))
+			},
+			want: []string{"127.0.0.1:8000", "127.0.0.1:8001", "127.0.0.1:8002", "127.0.0.1:8003"},
+		},
+	})
+}
+
+func TestResolverSelector(t *testing.T) {
+	runResolverTests(t, []resolverTest{
+		{
+			name:   "select the endpoints by version",
+			target: "my-service?version=v2",
+			want:   []string{"127.0.0.1:8001", "127.0.0.1:8002"},
+		},
+		{
+			name:   "select the endpoints by metadata",
+			target: "my-service?role=canary",
+			want:   []string{"127.0.0.1:8002"},
+		},
+		{
+			name:   "select the endpoints matching all the keys",
+			target: "my-service?version=v2&role=service",
+			want:   []string{"127.0.0.1:8001"},
+		},
+		{
+			name:   "select the endpoints matching any of the values",
+			target: "my-service?version=v1&version=v2&role=service",
+			want:   []string{"127.0.0.1:8000", "127.0.0.1:8001"},
+		},
+		{
+			name:   "select the endpoint updated to the version",
+			target: "my-service?version=v2",
+			action: func(t *testing.T, registry *MemoryRegistry) {
+				putService(t, registry, "my-service", "a", testEndpoint("8000", "v2"))
+			},
+			want: []string{"127.0.0.1:8000", "127.0.0.1:8001", "127.0.0.1:8002"},
+		},
+		{
+			name:   "select the new instance of the version",
+			target: "my-service?version=v3",
+			action: func(t *testing.T, registry *MemoryRegistry) {
+				putService(t, registry, "my-service", "c", testEndpoint("8003", "v3"))
+			},
+			want: []string{"127.0.0.1:8003"},
+		},
+	})
+}
+
+func TestResolverResync(t *testing.T) {
+	tests := []struct {
+		name   string
+		before bool // the changes are made before watching from the listed revision
+	}{
+		{name: "changes after watching are delivered"},
+		{name: "changes lost before watching are resynced", before: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := NewMemoryRegistry()
+			defer registry.Close()
+
+			putService(t, registry, "my-service", "a", Endpoint{IP: "127.0.0.1", Port: "8000"})
+			putService(t, registry, "my-service", "b", Endpoint{IP: "127.0.0.1", Port: "8001"})
+
+			cc := &testClientConn{}
+			s := &etcdResolver{
+				registry:   registry,
+				opts:       newOptions(),
+				cc:         cc,
+				resolveNow: make(chan struct{}, 1),
+				done:       make(chan struct{}),
+			}
+			defer s.Close()
+			s.prefix, s.subtree = servicePrefix(s.opts.namespace, "my-service")
+
+			index, policy, rev, err := s.list()
+			if err != nil {
+				t.Fatal(err)
+			}
+			unchanged := index["/services/my-service/b"][0]
+
+			change := func() {
+				registry.Expire("/services/my-service/a")
+				putService(t, registry, "my-service", "c", Endpoint{IP: "127.0.0.1", Port: "8002"})
+			}
+			if tt.before {
+				change()
+				go s.run(index, policy, rev)
+			} else {
+				go s.run(index, policy, rev)
+				// wait until the watch is started
+				for watching := false; !watching; time.Sleep(time.Millisecond * 10) {
+					registry.mu.Lock()
+					watching = len(registry.watchers) > 0
+					registry.mu.Unlock()
+				}
+				change()
+			}
+
+			state := cc.waitAddrs(t, "127.0.0.1:8001", "127.0.0.1:8002")
+			for _, addr := range state.Addresses {
+				if addr.Addr == unchanged.Addr && addr.Attributes != unchanged.Attributes {
+					t.Fatalf("address of the unchanged endpoint is recreated")
+				}
+			}
+		})
+	}
+}
+
+// unreachable registry fails to list the keys until it's reachable
+type unreachableRegistry struct {
+	*MemoryRegistry
+	unreachable int32
+}
+
+func (r *unreachableRegistry) List(ctx context.Context, prefix string) ([]*KeyValue, int64, error) {
+	if atomic.LoadInt32(&r.unreachable) == 1 {
+		return nil, 0, errors.New("registry is unreachable")
+	}
+	return r.MemoryRegistry.List(ctx, prefix)
+}
+
+func TestResolverUnreachable(t *testing.T) {
+	registry := &unreachableRegistry{MemoryRegistry: NewMemoryRegistry(), unreachable: 1}
+	defer registry.Close()
+
+	putService(t, registry, "my-service", "a", Endpoint{IP: "127.0.0.1", Port: "8000"})
+
+	// the resolver is built with the error reported
+	r, cc := buildResolver(t, registry, "my-service")
+	defer r.Close()
+	cc.waitAddrs(t)
+	cc.mu.Lock()
+	errs := len(cc.errs)
+	cc.mu.Unlock()
+	if errs == 0 {
+		t.Fatalf("error isn't reported")
+	}
+
+	// the service is listed again when the registry is reachable
+	atomic.StoreInt32(&registry.unreachable, 0)
+	cc.waitAddrs(t, "127.0.0.1:8000")
+}
+
+func TestResolverResolveNow(t *testing.T) {
+	registry := NewMemoryRegistry()
+	defer registry.Close()
+
+	s := &etcdResolver{
+		registry:   registry,
+		opts:       newOptions(),
+		cc:         &testClientConn{},
+		resolveNow: make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	defer s.Close()
+	s.prefix, s.subtree = servicePrefix(s.opts.namespace, "my-service")
+
+	index, policy, rev, err := s.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the request right after the listing is postponed instead of dropped
+	delay := time.Millisecond * 100
+	s.listed = time.Now().Add(delay - time.Second*ResolveNowInterval)
+	s.ResolveNow(resolver.ResolveNowOptions{})
+
+	start := time.Now()
+	s.handle(index, policy, rev)
+	if elapsed := time.Since(start); elapsed < delay/2 || elapsed > time.Second {
+		t.Fatalf("request to resolve again is handled after %v, want %v", elapsed, delay)
+	}
+}
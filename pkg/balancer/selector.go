@@ -0,0 +1,63 @@
+package balancer
+
+import (
+	"net/url"
+	"strings"
+)
+
+// selector filters the endpoints by version and metadata, e.g. 'version=v1.0.0&role=service'.
+// The endpoint is selected only if it matches all the keys, and any of the values for a key.
+type selector url.Values
+
+// parseTarget splits the target endpoint into the service name and the selector, e.g.
+// 'my-service?version=v1.0.0&role=service'
+func parseTarget(endpoint string) (string, selector, error) {
+	i := strings.Index(endpoint, "?")
+	if i < 0 {
+		return endpoint, nil, nil
+	}
+
+	values, err := url.ParseQuery(endpoint[i+1:])
+	if err != nil {
+		return "", nil, err
+	}
+	return endpoint[:i], selector(values), nil
+}
+
+// match returns true if the endpoint matches the selector
+func (s selector) match(ep Endpoint) bool {
+	for key, values := range s {
+		actual, ok := ep.Metadata[key]
+		if key == "version" {
+			actual, ok = ep.Version, true
+		}
+		if !ok || !contains(values, actual) {
+			return false
+		}
+	}
+	return true
+}
+
+// filter returns the endpoints which match the selector
+func (s selector) filter(eps []Endpoint) []Endpoint {
+	if len(s) == 0 {
+		return eps
+	}
+
+	var selected []Endpoint
+	for _, ep := range eps {
+		if s.match(ep) {
+			selected = append(selected, ep)
+		}
+	}
+	return selected
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
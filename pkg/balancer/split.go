@@ -0,0 +1,83 @@
+package balancer
+
+import (
+	"math/rand"
+	"strings"
+
+	"google.golang.org/grpc/resolver"
+	"gopkg.in/yaml.v2"
+)
+
+// SplitKey - the key of the traffic split policy under the service, e.g. '/services/my-service/_split'.
+// The policy is only honoured by the balancers 'weighted_round_robin' and 'locality_round_robin',
+// the other balancers ignore it with a warning.
+const SplitKey = "_split"
+
+// Split defines the traffic split policy between the service versions, the version and its
+// percentage of the calls, e.g. {"v1.0.0": 95, "v1.1.0": 5}. The endpoints of other versions
+// don't receive any call while the policy is set, the calls wait for the endpoints of the split
+// versions if none of them is ready.
+type Split map[string]int
+
+// the key of the traffic split policy in resolver state attributes
+type splitKey struct{}
+
+// parseSplit parses the traffic split policy in json or yaml
+func parseSplit(value []byte) (Split, error) {
+	var split Split
+	if err := yaml.Unmarshal(value, &split); err != nil {
+		return nil, err
+	}
+	for version, percent := range split {
+		if percent <= 0 {
+			delete(split, version)
+		}
+	}
+	return split, nil
+}
+
+// isReservedKey returns true if the key isn't a service instance, e.g. the traffic split policy
+func isReservedKey(key string) bool {
+	return strings.HasPrefix(key[strings.LastIndex(key, "/")+1:], "_")
+}
+
+// stateSplit returns the traffic split policy from the resolver state
+func stateSplit(state resolver.State) Split {
+	if state.Attributes != nil {
+		if split, ok := state.Attributes.Value(splitKey{}).(Split); ok {
+			return split
+		}
+	}
+	return nil
+}
+
+// addressVersion returns the endpoint version from the address attributes
+func addressVersion(addr resolver.Address) string {
+	ep, _ := AddressEndpoint(addr)
+	return ep.Version
+}
+
+// pick a version by the percentages, only the versions in the candidates are considered
+func (s Split) pick(candidates func(version string) bool) (string, bool) {
+	total := 0
+	for version, percent := range s {
+		if candidates(version) {
+			total += percent
+		}
+	}
+	if total == 0 {
+		return "", false
+	}
+
+	n := rand.Intn(total)
+	for version, percent := range s {
+		if !candidates(version) {
+			continue
+		}
+		if n < percent {
+			return version, true
+		}
+		n -= percent
+	}
+	return "", false
+}
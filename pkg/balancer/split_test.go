@@ -0,0 +1,100 @@
+package balancer
+
+import (
+	"context"
+	"testing"
+
+	grpcbalancer "google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+// test subconn implements interface 'SubConn'
+type testSubConn struct {
+	addr string
+}
+
+func (sc *testSubConn) UpdateAddresses(addrs []resolver.Address) {}
+
+func (sc *testSubConn) Connect() {}
+
+// readySubConns returns the picker build info with the ready subconns of the endpoints
+func readySubConns(eps ...Endpoint) base.PickerBuildInfo {
+	info := base.PickerBuildInfo{ReadySCs: make(map[grpcbalancer.SubConn]base.SubConnInfo)}
+	for _, ep := range eps {
+		addr := newAddress("id-"+ep.Port, ep)
+		info.ReadySCs[&testSubConn{addr: addr.Addr}] = base.SubConnInfo{Address: addr}
+	}
+	return info
+}
+
+func TestSplitPick(t *testing.T) {
+	eps := []Endpoint{
+		{IP: "127.0.0.1", Port: "8000", Version: "v1"},
+		{IP: "127.0.0.1", Port: "8001", Version: "v2"},
+	}
+
+	tests := []struct {
+		name     string
+		split    Split
+		builder  func(state *connState) base.V2PickerBuilder
+		versions map[string]bool // the versions receiving the calls, nil if no subconn is available
+	}{
+		{
+			name:     "no split policy",
+			builder:  func(state *connState) base.V2PickerBuilder { return &wrrPickerBuilder{state: state} },
+			versions: map[string]bool{"v1": true, "v2": true},
+		},
+		{
+			name:     "split to a ready version",
+			split:    Split{"v2": 100},
+			builder:  func(state *connState) base.V2PickerBuilder { return &wrrPickerBuilder{state: state} },
+			versions: map[string]bool{"v2": true},
+		},
+		{
+			name:    "split to the versions without ready peers",
+			split:   Split{"v3": 100},
+			builder: func(state *connState) base.V2PickerBuilder { return &wrrPickerBuilder{state: state} },
+		},
+		{
+			name:     "split with the locality picker",
+			split:    Split{"v1": 100},
+			builder:  func(state *connState) base.V2PickerBuilder { return &localityPickerBuilder{state: state} },
+			versions: map[string]bool{"v1": true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &connState{split: tt.split}
+			picker := tt.builder(state).Build(readySubConns(eps...))
+
+			picked := make(map[string]bool)
+			for i := 0; i < 20; i++ {
+				result, err := picker.Pick(grpcbalancer.PickInfo{Ctx: context.Background()})
+				if tt.versions == nil {
+					if err != grpcbalancer.ErrNoSubConnAvailable {
+						t.Fatalf("pick: %v, want ErrNoSubConnAvailable", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, ep := range eps {
+					if result.SubConn.(*testSubConn).addr == ep.IP+":"+ep.Port {
+						picked[ep.Version] = true
+					}
+				}
+			}
+			if len(picked) != len(tt.versions) {
+				t.Fatalf("picked versions %v, want %v", picked, tt.versions)
+			}
+			for version := range picked {
+				if !tt.versions[version] {
+					t.Fatalf("picked versions %v, want %v", picked, tt.versions)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package balancer
+
+import (
+	"strconv"
+	"sync"
+
+	grpcbalancer "google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+const (
+	// WeightedRoundRobin - the name of the weighted round robin balancer
+	WeightedRoundRobin = "weighted_round_robin"
+	// DefaultWeight - default weight for endpoint without the weight
+	DefaultWeight = 1
+)
+
+func init() {
+	grpcbalancer.Register(newBuilder(WeightedRoundRobin, func(state *connState) base.V2PickerBuilder {
+		return &wrrPickerBuilder{state: state}
+	}))
+}
+
+// weight returns the weight of the endpoint, from the field 'weight' or the metadata 'weight',
+// or the default weight if it's not set or invalid
+func (ep Endpoint) weight() int {
+	if ep.Weight > 0 {
+		return ep.Weight
+	}
+	if w, err := strconv.Atoi(ep.Metadata["weight"]); err == nil && w > 0 {
+		return w
+	}
+	return DefaultWeight
+}
+
+// addressWeight returns the endpoint weight from the address attributes
+func addressWeight(addr resolver.Address) int {
+	ep, _ := AddressEndpoint(addr)
+	return ep.weight()
+}
+
+// weighted round robin picker builder implements interface 'V2PickerBuilder'
+type wrrPickerBuilder struct {
+	state *connState // the state of the client connection
+}
+
+// Build returns a weighted round robin picker with the ready subconns
+func (b *wrrPickerBuilder) Build(info base.PickerBuildInfo) grpcbalancer.V2Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPickerV2(grpcbalancer.ErrNoSubConnAvailable)
+	}
+
+	picker := newWrrPicker(b.state)
+	for sc, sci := range info.ReadySCs {
+		picker.add(sc, sci.Address)
+	}
+	return picker
+}
+
+// the peer with the weight and the current weight for the smooth weighted round robin
+type wrrPeer struct {
+	subConn grpcbalancer.SubConn
+	weight  int
+	current int
+}
+
+// the smooth weighted round robin as nginx, which spreads the picks of the heavy peer evenly
+type wrr struct {
+	peers []*wrrPeer
+	total int // the total weight of the peers
+}
+
+// add the peer with the weight
+func (w *wrr) add(sc grpcbalancer.SubConn, weight int) {
+	w.peers = append(w.peers, &wrrPeer{subConn: sc, weight: weight})
+	w.total += weight
+}
+
+// next returns the peer with the max current weight
+func (w *wrr) next() grpcbalancer.SubConn {
+	var best *wrrPeer
+	total := 0
+	for _, peer := range w.peers {
+		peer.current += peer.weight
+		total += peer.weight
+		if best == nil || peer.current > best.current {
+			best = peer
+		}
+	}
+	best.current -= total
+
+	return best.subConn
+}
+
+// weighted round robin picker implements interface 'V2Picker', the version is picked by the
+// traffic split policy first if it's set, then the peer of the version by the weights
+type wrrPicker struct {
+	state *connState // the state of the client connection
+
+	mu       sync.Mutex
+	all      *wrr            // all the peers
+	versions map[string]*wrr // the peers of each version
+}
+
+// newWrrPicker returns a weighted round robin picker without any peer
+func newWrrPicker(state *connState) *wrrPicker {
+	return &wrrPicker{
+		state:    state,
+		all:      &wrr{},
+		versions: make(map[string]*wrr),
+	}
+}
+
+// add the peer with the weight and version from the address
+func (p *wrrPicker) add(sc grpcbalancer.SubConn, addr resolver.Address) {
+	weight := addressWeight(addr)
+	p.all.add(sc, weight)
+
+	// group the peers by version for the traffic split policy
+	version := addressVersion(addr)
+	if p.versions[version] == nil {
+		p.versions[version] = &wrr{}
+	}
+	p.versions[version].add(sc, weight)
+}
+
+// empty returns true if there isn't any peer
+func (p *wrrPicker) empty() bool {
+	return len(p.all.peers) == 0
+}
+
+// weight returns the total weight of the peers
+func (p *wrrPicker) weight() int {
+	return p.all.total
+}
+
+// Pick the peer by the traffic split policy and the weights
+func (p *wrrPicker) Pick(info grpcbalancer.PickInfo) (grpcbalancer.PickResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	peers := p.all
+	if split := p.state.Split(); len(split) > 0 {
+		// the versions without any ready peer are skipped
+		version, ok := split.pick(func(version string) bool {
+			return p.versions[version] != nil
+		})
+		// the other versions don't receive any call even if the split versions aren't ready
+		if !ok {
+			return grpcbalancer.PickResult{}, grpcbalancer.ErrNoSubConnAvailable
+		}
+		peers = p.versions[version]
+	}
+
+	return grpcbalancer.PickResult{SubConn: peers.next()}, nil
+}
@@ -0,0 +1,80 @@
+package balancer
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	grpcbalancer "google.golang.org/grpc/balancer"
+)
+
+func TestWRRNext(t *testing.T) {
+	tests := []struct {
+		name        string
+		weights     []int
+		consecutive int // the max consecutive picks of the same peer in a round
+	}{
+		{name: "same weights", weights: []int{1, 1, 1}, consecutive: 1},
+		{name: "heavy peer is spread", weights: []int{5, 1, 1}, consecutive: 2},
+		{name: "close weights", weights: []int{3, 2}, consecutive: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &wrr{}
+			for i, weight := range tt.weights {
+				w.add(&testSubConn{addr: strconv.Itoa(i)}, weight)
+			}
+
+			// each round picks the peers exactly by the weights
+			for round := 0; round < 3; round++ {
+				picked := make([]int, len(tt.weights))
+				last, consecutive := "", 0
+				for i := 0; i < w.total; i++ {
+					addr := w.next().(*testSubConn).addr
+					if addr == last {
+						consecutive++
+					} else {
+						last, consecutive = addr, 1
+					}
+					if consecutive > tt.consecutive {
+						t.Fatalf("peer %s is picked %d times in a row", addr, consecutive)
+					}
+					peer, _ := strconv.Atoi(addr)
+					picked[peer]++
+				}
+				for i, weight := range tt.weights {
+					if picked[i] != weight {
+						t.Fatalf("round %d picked %v, want %v", round, picked, tt.weights)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestWRRPick(t *testing.T) {
+	eps := []Endpoint{
+		{IP: "127.0.0.1", Port: "8000", Weight: 3},
+		{IP: "127.0.0.1", Port: "8001", Metadata: map[string]string{"weight": "2"}},
+		{IP: "127.0.0.1", Port: "8002", Metadata: map[string]string{"weight": "invalid"}},
+	}
+	picker := (&wrrPickerBuilder{state: &connState{}}).Build(readySubConns(eps...))
+
+	picked := make(map[string]int)
+	for i := 0; i < 60; i++ {
+		result, err := picker.Pick(grpcbalancer.PickInfo{Ctx: context.Background()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked[result.SubConn.(*testSubConn).addr]++
+	}
+
+	// the weight is from the field, the metadata, or the default
+	want := map[string]int{"127.0.0.1:8000": 30, "127.0.0.1:8001": 20, "127.0.0.1:8002": 10}
+	for addr, n := range want {
+		if picked[addr] != n {
+			t.Fatalf("picked %v, want %v", picked, want)
+		}
+	}
+}